@@ -1,8 +1,11 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,8 +14,10 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Alex1ch/AppChatty/protocol"
 	"github.com/gotk3/gotk3/glib"
 
 	"github.com/gotk3/gotk3/pango"
@@ -21,11 +26,18 @@ import (
 	"github.com/gotk3/gotk3/gtk"
 )
 
+// HISTORYPAGESIZE Count of stored messages loaded at once, the server sends at most 100
+const HISTORYPAGESIZE = 50
+
 type message struct {
 	senderID uint64
 	name     string
 	text     string
 	row      *gtk.ListBoxRow
+	id       uint64
+	state    byte       // delivery state, acknowledged state for incoming messages
+	status   *gtk.Label // delivery state label of own messages
+	sent     time.Time  // server time, zero if unknown
 }
 
 type chat struct {
@@ -37,8 +49,11 @@ type chat struct {
 }
 
 var (
-	connection   net.Conn
-	subscribtion net.Conn
+	connection   *protocol.Conn
+	commands     *protocol.Dispatcher
+	subscribtion *protocol.Conn
+	events       *protocol.Dispatcher // commands in multiplexed mode
+	pushes       chan *protocol.Packet
 	buffersize   int
 
 	gtkAlive bool
@@ -48,6 +63,7 @@ var (
 	authWin        *gtk.Window
 	settingsWin    *gtk.Window
 	addGroupWin    *gtk.Window
+	browseGroupWin *gtk.Window
 	messageText    *gtk.TextBuffer
 	messageOutput  *gtk.ListBox
 	сontactsList   *gtk.ListBox
@@ -56,9 +72,13 @@ var (
 	stickerList    *gtk.ListBox
 	stickerScroll  *gtk.ScrolledWindow
 	groupNameEntry *gtk.Entry
+	groupPublic    *gtk.CheckButton
+	groupSearch    *gtk.Entry
+	groupResults   *gtk.ListBox
 	ipEntry        *gtk.Entry
 	portEntry      *gtk.Entry
 	usernameLabel  *gtk.Label
+	chatHeader     *gtk.Label
 
 	stickerScrollAdj float64
 	stickerScrollUpp float64
@@ -66,26 +86,39 @@ var (
 	usernames    map[uint64]string
 	userids      map[string]uint64
 	groupnames   map[uint64]string
+	groupTopics  map[uint64]string
 	chats        map[uint64]*chat // [user_id]chat struct
 	newMCounters map[uint64]int
+	historyDone  map[uint64]bool        // chats whose stored messages are loaded
+	historyMore  map[uint64]bool        // chats with older stored messages to load
 	settings     map[string]string      // [key]value
 	stickerBuf   map[string]*gdk.Pixbuf // [filename]pixbuf
 
+	foundGroups []protocol.GroupInfo // rows of groupResults
+	foundRows   []*gtk.ListBoxRow
+
 	chatCount  uint64
 	online     bool
 	activeChat uint64
 	clUsername string
 	clID       uint64
+
+	sessionToken string     // replaces the password on reconnects, "" after logout
+	sessionMutex sync.Mutex // serializes resumes of the session
 )
 
 func main() {
 	chats = make(map[uint64]*chat)
 	newMCounters = make(map[uint64]int)
+	historyDone = make(map[uint64]bool)
+	historyMore = make(map[uint64]bool)
 	settings = make(map[string]string)
 	usernames = make(map[uint64]string)
 	groupnames = make(map[uint64]string)
+	groupTopics = make(map[uint64]string)
 	userids = make(map[string]uint64)
 	stickerBuf = make(map[string]*gdk.Pixbuf)
+	pushes = make(chan *protocol.Packet, 64)
 
 	if parseSettings() != 0 {
 		return
@@ -105,7 +138,6 @@ func main() {
 	connectToServer()
 
 	go gtk.Main()
-	go onlineChecker()
 	listenMessages()
 }
 
@@ -122,12 +154,7 @@ func initWindows() int {
 	mainWindow.Connect("destroy", func() {
 		gtkAlive = false
 		gtk.MainQuit()
-		if connection != nil {
-			connection.Close()
-		}
-		if subscribtion != nil {
-			subscribtion.Close()
-		}
+		disconnect()
 	})
 	mainWindow.ShowAll()
 
@@ -174,6 +201,16 @@ func initWindows() int {
 	}
 	usernameLabel = obj.(*gtk.Label)
 
+	//
+	//ChatHeader
+	//
+	obj, err = builder.GetObject("ChatHeader")
+	if err != nil {
+		log.Fatal("Error:", err)
+		return 2
+	}
+	chatHeader = obj.(*gtk.Label)
+
 	//
 	//MessageEntry
 	//
@@ -262,6 +299,81 @@ func initWindows() int {
 
 	})
 
+	//
+	// Password entries
+	//
+	obj, err = builder.GetObject("OldPassword")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	oldPassEntry := obj.(*gtk.Entry)
+
+	obj, err = builder.GetObject("NewPassword")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	newPassEntry := obj.(*gtk.Entry)
+
+	//
+	//Change password button
+	//
+	obj, err = builder.GetObject("ChangePassword")
+	if err != nil {
+		log.Fatal("Error:", err)
+		return 2
+	}
+	changePassBtn := obj.(*gtk.Button)
+	changePassBtn.Connect("clicked", func() {
+		oldPass, _ := oldPassEntry.GetText()
+		newPass, _ := newPassEntry.GetText()
+		if oldPass == "" || newPass == "" {
+			popupError("Enter the current and the new password", "Error")
+			return
+		}
+		err := changePassword(oldPass, newPass)
+		if err != nil {
+			popupError("Error: "+err.Error(), "Error")
+			return
+		}
+		oldPassEntry.SetText("")
+		newPassEntry.SetText("")
+		popupInfo("Password changed", "Settings")
+	})
+
+	//
+	//Delete account button
+	//
+	obj, err = builder.GetObject("DeleteAccount")
+	if err != nil {
+		log.Fatal("Error:", err)
+		return 2
+	}
+	deleteAccBtn := obj.(*gtk.Button)
+	deleteAccBtn.Connect("clicked", func() {
+		password, _ := oldPassEntry.GetText()
+		if password == "" {
+			popupError("Enter the current password", "Error")
+			return
+		}
+		confirm := gtk.MessageDialogNew(settingsWin, 0, gtk.MESSAGE_WARNING, gtk.BUTTONS_YES_NO, "Delete the account "+clUsername+"?\nOwned groups pass to the member with the highest role.")
+		answer := confirm.Run()
+		confirm.Destroy()
+		if answer != gtk.RESPONSE_YES {
+			return
+		}
+		err := deleteAccount(password)
+		if err != nil {
+			popupError("Error: "+err.Error(), "Error")
+			return
+		}
+		oldPassEntry.SetText("")
+		newPassEntry.SetText("")
+		settingsWin.Hide()
+		connectToServer()
+	})
+
 	//
 	//Send button
 	//
@@ -306,6 +418,11 @@ func initWindows() int {
 	}
 	ReconnectBtn := obj.(*gtk.EventBox)
 	ReconnectBtn.Connect("button-release-event", func() {
+		if online {
+			logout()
+		} else if sessionToken != "" && resumeSession() == nil {
+			return
+		}
 		connectToServer()
 	})
 
@@ -397,6 +514,11 @@ func initWindows() int {
 		return 4
 	}
 	messageScroll = obj.(*gtk.ScrolledWindow)
+	messageScroll.Connect("edge-reached", func(scroll *gtk.ScrolledWindow, pos gtk.PositionType) {
+		if pos == gtk.POS_TOP && activeChat != 0 {
+			loadOlderHistory(activeChat)
+		}
+	})
 
 	//
 	//ContactsList
@@ -424,6 +546,7 @@ func initWindows() int {
 		}
 		redrawChat(activeChat, chatID)
 		activeChat = chatID
+		showChatHeader()
 	})
 
 	//
@@ -461,10 +584,7 @@ func initWindows() int {
 		err = addContact(0, str, 0)
 		if err != nil {
 			if err == io.EOF {
-				connection.Close()
-				connection = nil
-				subscribtion.Close()
-				subscribtion = nil
+				disconnect()
 				setOnline(false)
 			}
 			popupError("Error: "+err.Error(), "Error")
@@ -531,6 +651,103 @@ func initWindows() int {
 	}
 	groupNameEntry = obj.(*gtk.Entry)
 
+	//
+	//Public group checkbox
+	//
+	obj, err = builder.GetObject("GroupPublic")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	groupPublic = obj.(*gtk.CheckButton)
+
+	//
+	//Browse groups button
+	//
+	obj, err = builder.GetObject("BrowseGroupsBtn")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	browseGroupsBtn := obj.(*gtk.Button)
+	browseGroupsBtn.Connect("clicked", func() {
+		addGroupWin.Hide()
+		browseGroupWin.ShowAll()
+	})
+
+	//
+	//Browse groups window
+	//
+	obj, err = builder.GetObject("BrowseGroups")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	browseGroupWin = obj.(*gtk.Window)
+	browseGroupWin.Connect("delete-event", func() bool {
+		browseGroupWin.Hide()
+		return true
+	})
+	browseGroupWin.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	//
+	//Group search
+	//
+	obj, err = builder.GetObject("GroupSearch")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	groupSearch = obj.(*gtk.Entry)
+	groupSearch.Connect("activate", func() {
+		err := searchGroups()
+		if err != nil {
+			popupError("Error: "+err.Error(), "Error")
+		}
+	})
+
+	obj, err = builder.GetObject("GroupSearchBtn")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	groupSearchBtn := obj.(*gtk.Button)
+	groupSearchBtn.Connect("clicked", func() {
+		err := searchGroups()
+		if err != nil {
+			popupError("Error: "+err.Error(), "Error")
+		}
+	})
+
+	//
+	//Found groups
+	//
+	obj, err = builder.GetObject("GroupResults")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	groupResults = obj.(*gtk.ListBox)
+
+	obj, err = builder.GetObject("JoinGroupBtn")
+	if err != nil {
+		log.Fatal("Error in object getting:", err)
+		return 2
+	}
+	joinGroupBtn := obj.(*gtk.Button)
+	joinGroupBtn.Connect("clicked", func() {
+		row := groupResults.GetSelectedRow()
+		if row == nil {
+			return
+		}
+		err := joinGroup(foundGroups[row.GetIndex()])
+		if err != nil {
+			popupError("Error: "+err.Error(), "Error")
+			return
+		}
+		browseGroupWin.Hide()
+	})
+
 	//
 	//Popover Stiker
 	//
@@ -591,29 +808,11 @@ func connectToServer() int { //connection net.Conn {
 	_, ok := settings["ip"]
 	if ok {
 		//Connecting to server
-		var err error
 		if connection != nil {
-			connection.Close()
-			connection = nil
-			subscribtion.Close()
-			subscribtion = nil
-			setOnline(false)
-		}
-		connection, err = net.Dial("tcp", settings["ip"]+":"+settings["port"])
-		if err != nil {
-			popupError("Can't connect to the server\nException: "+err.Error(), "Error")
-			return 1
-		}
-
-		//Subscribe to server
-		if subscribtion != nil {
-			connection.Close()
-			connection = nil
-			subscribtion.Close()
-			subscribtion = nil
+			disconnect()
 			setOnline(false)
 		}
-		subscribtion, err = net.Dial("tcp", settings["ip"]+":"+settings["port"])
+		err := dialServer()
 		if err != nil {
 			popupError("Can't connect to the server\nException: "+err.Error(), "Error")
 			return 1
@@ -630,172 +829,297 @@ func connectToServer() int { //connection net.Conn {
 	return 0
 }
 
-//
-// Packet reading
-//
-
-func readPacket(client net.Conn, timeout int64) (out_err error, dataLen uint16, opCode uint16, buffer []byte) {
-	//defer readRecover(client, &exitCode)
-	if timeout != 0 {
-		client.SetReadDeadline(time.Now().Add(time.Duration(timeout * int64(time.Second))))
-	} else {
-		client.SetReadDeadline(time.Time{})
-	}
-	if client == nil {
-		return errors.New("No subscription available"), 0, 0, nil
+func dial() (*protocol.Conn, error) {
+	address := settings["ip"] + ":" + settings["port"]
+	if settings["tls"] != "true" {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.NewConn(conn), nil
 	}
-	dataLenB := make([]byte, 2)
-	_, err := client.Read(dataLenB)
+
+	config, err := tlsConfig()
 	if err != nil {
-		fmt.Println("Error in message receiving(len): " + err.Error())
-		client.Close()
-		out_err = err
-		return
+		return nil, err
 	}
-	dataLen = binary.LittleEndian.Uint16(dataLenB)
-	opCodeB := make([]byte, 2)
-	_, err = client.Read(opCodeB)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, config)
 	if err != nil {
-		fmt.Println("Error in message receiving(opCode): " + err.Error())
-		client.Close()
-		out_err = err
-		return
+		return nil, err
+	}
+	return protocol.NewConn(conn), nil
+}
+
+// tlsConfig verifies the server with the CA from "ca-file" (system CAs by
+// default) or, if "pin" is set, with the SHA-256 fingerprint of its
+// certificate, which suits self-signed servers
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: settings["ip"], MinVersion: tls.VersionTLS12}
+	if name, ok := settings["server-name"]; ok {
+		config.ServerName = name
 	}
-	opCode = binary.LittleEndian.Uint16(opCodeB)
-	if dataLen != 0 {
-		buffer = make([]byte, dataLen)
-		_, err = client.Read(buffer)
+	if path, ok := settings["ca-file"]; ok {
+		pem, err := ioutil.ReadFile(path)
 		if err != nil {
-			fmt.Println("Error in message receiving(data): " + err.Error())
-			client.Close()
-			out_err = err
-			return
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates in " + path)
+		}
+		config.RootCAs = pool
+	}
+	if pin, ok := settings["pin"]; ok {
+		expected, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+		if err != nil || len(expected) != sha256.Size {
+			return nil, errors.New("Wrong value for \"pin\" in settings")
+		}
+		// The pin replaces the verification of the chain and the name
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("Server has no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(sum[:], expected) != 1 {
+				return errors.New("Server certificate doesn't match the pin")
+			}
+			return nil
 		}
-	} else {
-		buffer = nil
-		return
 	}
-	return
+	return config, nil
 }
 
-func sendPacket(client net.Conn, opCode uint16, data []byte) error {
-	var buffer bytes.Buffer
-	opCodeB := make([]byte, 2)
-	if data != nil {
-		lenB := make([]byte, 2)
-		length := len(data)
-		if len(data) > 65535 {
-			return errors.New("Data is to big, packet split is not implemented")
-		}
-		binary.LittleEndian.PutUint16(lenB, uint16(length))
-		binary.LittleEndian.PutUint16(opCodeB, opCode)
-
-		buffer.Write(lenB)
-		buffer.Write(opCodeB)
-		buffer.Write(data)
-		_, err := client.Write(buffer.Bytes())
-		if err != nil {
-			fmt.Println("Error in message sending: " + err.Error())
-			return err
-		}
-		return nil
-	} else {
-		lenB := []byte{0, 0}
-		binary.LittleEndian.PutUint16(opCodeB, opCode)
+// dialServer opens the command connection, the subscription connection is
+// opened after the authentication
+func dialServer() error {
+	var err error
+	connection, err = dial()
+	if err != nil {
+		return err
+	}
+	commands = protocol.NewDispatcher(connection, pushes)
+	return nil
+}
 
-		buffer.Write(lenB)
-		buffer.Write(opCodeB)
-		_, err := client.Write(buffer.Bytes())
-		if err != nil {
-			fmt.Println("Error in message sending: " + err.Error())
-			return err
-		}
-		return nil
+func disconnect() {
+	if connection != nil {
+		connection.Close()
+	}
+	if subscribtion != nil {
+		subscribtion.Close()
 	}
+	connection = nil
+	commands = nil
+	subscribtion = nil
+	events = nil
+}
+
+func multiplexed() bool {
+	return settings["multiplex"] == "true"
 }
 
 //
 //Online parts
 //
 
-func sendRegisterOrAuthAndSubscribe(username, password string, auth bool) error {
-	var buffer bytes.Buffer
+// sendRegisterOrAuthAndSubscribe authenticates the connections with the
+// password or, with resume set, with the session token in secret
+func sendRegisterOrAuthAndSubscribe(username, secret string, auth, resume bool) error {
+	credentials := protocol.Credentials{Username: username, Password: secret}
+	if multiplexed() {
+		credentials.Options |= protocol.OptionMultiplex
+	}
+	if resume {
+		credentials.Options |= protocol.OptionToken
+	}
+	data, err := credentials.Marshal()
+	if err != nil {
+		return err
+	}
+	var op protocol.OpCode
+	if auth {
+		op = protocol.OpAuth
+	} else {
+		op = protocol.OpRegister
+	}
 
-	usernameB := []byte(username)
-	passwordB := []byte(password)
-	nLen := len(usernameB)
-	pLen := len(passwordB)
+	packet, err := commands.Request(op, data, 2*time.Second)
+	if err != nil {
+		return errors.New("Server not responding")
+	}
 
-	if pLen > 255 || nLen < 0 {
-		return errors.New("Password is too big")
+	if resume && packet.OpCode == protocol.StatusUnauthorized {
+		sessionToken = "" // Expired or revoked, the password is needed
+	}
+	err = authError(packet)
+	if err != nil {
+		return err
 	}
-	if nLen > 255 || nLen < 0 {
-		return errors.New("Username is too big")
+	var response protocol.AuthResponse
+	err = response.Unmarshal(packet.Data)
+	if err != nil {
+		return err
 	}
+	sessionToken = response.Token
+	clID = response.UserID
 
-	buffer.WriteByte(byte(nLen))
-	buffer.Write(usernameB)
-	buffer.WriteByte(byte(pLen))
-	buffer.Write(passwordB)
-	var op uint16
-	if auth {
-		op = 5
-	} else {
-		op = 4
+	if multiplexed() {
+		events = commands
+		return nil
 	}
 
-	err := sendPacket(connection, op, buffer.Bytes())
+	// The subscription gets the token, so the password is sent only once
+	credentials = protocol.Credentials{Username: username, Password: sessionToken, Options: protocol.OptionToken}
+	data, err = credentials.Marshal()
+	if err != nil {
+		return err
+	}
+	subscribtion, err = dial()
+	if err != nil {
+		return err
+	}
+	err = subscribtion.SendPacket(protocol.OpSubscribe, data)
 	if err != nil {
 		return err
 	}
 
-	err, _, opCode, _ := readPacket(connection, 2)
+	packet, err = subscribtion.ReadPacket(5 * time.Second)
 	if err != nil {
 		return errors.New("Server not responding")
 	}
 
-	switch opCode {
-	case 200:
+	err = authError(packet)
+	if err != nil {
+		return err
+	}
+	events = protocol.NewDispatcher(subscribtion, pushes)
+	return nil
+}
 
-	case 404:
+func authError(packet *protocol.Packet) error {
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		return nil
+	case protocol.StatusNotFound:
 		return errors.New("404: Not found. \nUser doesn't exists")
-	case 406:
+	case protocol.StatusUnauthorized:
+		return errors.New("401: Unauthorized. \nSession expired, sign in again")
+	case protocol.StatusNotAcceptable:
+		var response protocol.ErrorResponse
+		if response.Unmarshal(packet.Data) == nil {
+			return errors.New("406: Not acceptable. \n" + response.Reason)
+		}
 		return errors.New("406: Not acceptable. \nUser already exists")
-	case 423:
+	case protocol.StatusLocked:
 		return errors.New("423: Locked. Wrong password")
-	case 409:
-		return errors.New("409: Conflict. User is already online")
-	case 400:
+	case protocol.StatusTooManyRequests:
+		var response protocol.RetryResponse
+		response.Unmarshal(packet.Data)
+		return fmt.Errorf("429: Too many attempts. \nTry again in %d seconds", response.Seconds)
+	case protocol.StatusBadRequest:
 		return errors.New("400: Bad request")
 	default:
-		return errors.New(fmt.Sprint("Unhandled server response - ", opCode))
+		return errors.New(fmt.Sprint("Unhandled server response - ", packet.OpCode))
 	}
+}
 
-	err = sendPacket(subscribtion, 10, buffer.Bytes())
+// resumeSession reconnects with the session token, without asking the user
+// for the password
+func resumeSession() error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	if online {
+		return nil
+	}
+	if sessionToken == "" || clUsername == "" {
+		return errors.New("No session to resume")
+	}
+	disconnect()
+	err := dialServer()
 	if err != nil {
 		return err
 	}
+	err = sendRegisterOrAuthAndSubscribe(clUsername, sessionToken, true, true)
+	if err != nil {
+		disconnect()
+		return err
+	}
+	// Messages sent while the connection was lost are loaded with the history
+	historyDone = make(map[uint64]bool)
+	setOnline(true)
+	glib.IdleAdd(watchContacts)
+	return nil
+}
+
+// logout revokes the session token on the server and disconnects
+func logout() {
+	token := sessionToken
+	sessionToken = "" // Stops the resume of the session
+	if commands != nil && token != "" {
+		request := protocol.LogoutRequest{Token: token}
+		data, err := request.Marshal()
+		if err == nil {
+			commands.Request(protocol.OpLogout, data, 2*time.Second)
+		}
+	}
+	disconnect()
+	setOnline(false)
+}
 
-	err, _, opCode, _ = readPacket(subscribtion, 5)
+func changePassword(oldPassword, newPassword string) error {
+	if commands == nil {
+		return errors.New("No connection")
+	}
+	request := protocol.ChangePasswordRequest{OldPassword: oldPassword, NewPassword: newPassword}
+	data, err := request.Marshal()
 	if err != nil {
-		return errors.New("Server not responding")
+		return err
+	}
+	packet, err := commands.Request(protocol.OpChangePassword, data, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		var response protocol.AuthResponse
+		err = response.Unmarshal(packet.Data)
+		if err != nil {
+			return err
+		}
+		sessionToken = response.Token // The other sessions are logged out
+		return nil
+	case protocol.StatusLocked:
+		return errors.New("423: Locked. Wrong password")
+	default:
+		return authError(packet)
 	}
+}
 
-	switch opCode {
-	case 200:
+// deleteAccount deletes the account on the server and disconnects
+func deleteAccount(password string) error {
+	if commands == nil {
+		return errors.New("No connection")
+	}
+	request := protocol.DeleteAccountRequest{Password: password}
+	data, err := request.Marshal()
+	if err != nil {
+		return err
+	}
+	packet, err := commands.Request(protocol.OpDeleteAccount, data, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		sessionToken = ""
+		disconnect()
+		setOnline(false)
 		return nil
-	case 404:
-		return errors.New("404: Not found. \nUser doesn't exists")
-	case 406:
-		return errors.New("406: Not acceptable. \nUser already exists")
-	case 423:
+	case protocol.StatusLocked:
 		return errors.New("423: Locked. Wrong password")
-	case 409:
-		return errors.New("409: Conflict. User is already online")
-	case 400:
-		return errors.New("400: Bad request")
 	default:
-		return errors.New(fmt.Sprint("Unhandled server response - ", opCode))
+		return authError(packet)
 	}
 }
 
@@ -834,10 +1158,11 @@ func setOnline(_online bool) {
 }
 
 func establishConnetcion(auth bool, authPass, authUser *gtk.Entry) error {
+	sessionMutex.Lock() // No resume of the previous session meanwhile
+	defer sessionMutex.Unlock()
 	var err error
 	if connection == nil {
-		connection, err = net.Dial("tcp", settings["ip"]+":"+settings["port"])
-		subscribtion, err = net.Dial("tcp", settings["ip"]+":"+settings["port"])
+		err = dialServer()
 		if err != nil {
 			return err
 		}
@@ -856,60 +1181,56 @@ func establishConnetcion(auth bool, authPass, authUser *gtk.Entry) error {
 	if password == "" {
 		return errors.New("Empty password")
 	}
-	err = sendRegisterOrAuthAndSubscribe(username, password, auth)
+	err = sendRegisterOrAuthAndSubscribe(username, password, auth, false)
 	if err != nil {
-		connection.Close()
-		connection = nil
-		subscribtion.Close()
-		subscribtion = nil
+		disconnect()
 		return err
 	}
 	clUsername = username
 	usernameLabel.SetText(username)
-	clID, err = getUserID(clUsername)
-	if err != nil {
-		return err
-	}
 	setOnline(true)
+	glib.IdleAdd(watchContacts)
 	authWin.Hide()
 	return nil
 }
 
 func sendMessage(str string, clear bool) {
 	if activeChat != 0 {
-
-		serial := createSerializer()
-		serial.UInt64(clID)
-		if chats[activeChat].group == false {
-			serial.UInt64(chats[activeChat].id)
-			serial.UInt64(0)
-		} else {
-			serial.UInt64(0)
-			serial.UInt64(chats[activeChat].id)
-		}
-		msgLen := len([]byte(str))
-		if msgLen > 65535 {
-			popupError("Message is too long", "Error")
+		if chats[activeChat].group && strings.HasPrefix(str, "/") && sendGroupCommand(chats[activeChat].id, str) {
+			if clear {
+				glib.IdleAdd(clearText)
+			}
 			return
 		}
-		serial.String(str, 2)
-		err := sendPacket(connection, 1, serial.buffer.Bytes())
+
+		request := protocol.Message{SenderID: clID, Text: str}
+		if chats[activeChat].group == false {
+			request.UserID = chats[activeChat].id
+		} else {
+			request.GroupID = chats[activeChat].id
+		}
+		data, err := request.Marshal()
 		if err != nil {
-			popupError("Error: "+err.Error(), "Error")
+			popupError("Message is too long", "Error")
 			return
 		}
-
-		err, _, opCode, _ := readPacket(connection, 5)
+		packet, err := commands.Request(protocol.OpMessage, data, 5*time.Second)
 		if err != nil {
 			popupError("Server is not responding", "Error")
 			return
 		}
 
-		switch opCode {
-		case 200:
+		switch packet.OpCode {
+		case protocol.StatusOK, protocol.StatusAccepted:
+			var response protocol.MessageResponse
+			response.Unmarshal(packet.Data)
 			chatEntry := chats[activeChat]
-			row := createRow(clID, clUsername, str, false)
-			chatEntry.messages = append(chatEntry.messages, message{clID, clUsername, str, row})
+			sent := protocol.TimeFromTimestamp(response.Timestamp)
+			row, status := createRow(clID, clUsername, str, false, sent)
+			if packet.OpCode == protocol.StatusAccepted {
+				status.SetText("✓ queued") // Waits on the server for an offline recipient
+			}
+			chatEntry.messages = append(chatEntry.messages, message{clID, clUsername, str, row, response.MessageID, protocol.ReceiptSent, status, sent})
 			chats[activeChat] = chatEntry
 
 			messageOutput.Add(row)
@@ -921,15 +1242,161 @@ func sendMessage(str string, clear bool) {
 				glib.IdleAdd(clearText)
 			}
 			return
-		case 400:
+		case protocol.StatusBadRequest:
 			popupError("400: Bad syntax", "Error")
 			return
-		case 404:
+		case protocol.StatusNotFound:
 			popupError("404: User doesn't exist", "Error")
 			return
+		case protocol.StatusPayloadTooLarge:
+			popupError("413: Message is too long", "Error")
+			return
+		}
+
+	}
+}
+
+// sendGroupCommand runs a slash command with opcode 19 and shows its result in
+// the active chat. Returns false if the server doesn't know the command, it
+// is sent as a message then.
+func sendGroupCommand(groupID uint64, str string) bool {
+	fields := strings.Fields(str[1:])
+	if len(fields) == 0 {
+		return false
+	}
+	request := protocol.GroupCommandRequest{GroupID: groupID, Command: fields[0], Args: fields[1:]}
+	data, err := request.Marshal()
+	if err != nil {
+		popupError(err.Error(), "Error")
+		return true
+	}
+	packet, err := commands.Request(protocol.OpGroupCommand, data, 5*time.Second)
+	if err != nil {
+		popupError("Server is not responding", "Error")
+		return true
+	}
+
+	var text string
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		var response protocol.GroupCommandResponse
+		response.Unmarshal(packet.Data)
+		text = response.Text
+	case protocol.StatusNotFound:
+		return false
+	default:
+		var response protocol.ErrorResponse
+		response.Unmarshal(packet.Data)
+		text = response.Reason
+	}
+	if text != "" {
+		showSystemText(text)
+	}
+	return true
+}
+
+// showInvite asks the user to accept or decline an invitation to a group
+func showInvite(invite protocol.Invite) {
+	text := invite.Inviter + " invites you to the group " + invite.GroupName + "\nThe invitation expires " + protocol.TimeFromTimestamp(invite.ExpiresAt).Local().Format("2 Jan 15:04")
+	dialog := gtk.MessageDialogNew(nil, 0, gtk.MESSAGE_QUESTION, gtk.BUTTONS_NONE, text)
+	dialog.SetTitle("Invitation")
+	dialog.AddButton("Decline", gtk.RESPONSE_REJECT)
+	dialog.AddButton("Accept", gtk.RESPONSE_ACCEPT)
+	answer := dialog.Run()
+	dialog.Destroy()
+	if answer != gtk.RESPONSE_ACCEPT && answer != gtk.RESPONSE_REJECT {
+		return // Closed, the invitation comes again with the next subscription
+	}
+	groupID, err := answerInvite(invite.InviteID, answer == gtk.RESPONSE_ACCEPT)
+	if err != nil {
+		popupError("Error: "+err.Error(), "Error")
+		return
+	}
+	if answer == gtk.RESPONSE_ACCEPT {
+		addContact(1, invite.GroupName, groupID) // Fails if the hello of the group came first
+	}
+}
+
+// answerInvite accepts or declines an invitation, returns the joined group
+func answerInvite(inviteID uint64, accept bool) (uint64, error) {
+	if commands == nil {
+		return 0, errors.New("Not connected")
+	}
+	request := protocol.InviteRequest{InviteID: inviteID}
+	data, _ := request.Marshal()
+	opCode := protocol.OpDeclineInvite
+	if accept {
+		opCode = protocol.OpAcceptInvite
+	}
+	packet, err := commands.Request(opCode, data, 5*time.Second)
+	if err != nil {
+		return 0, errors.New("Server is not responding")
+	}
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		var response protocol.JoinResponse
+		if accept {
+			if err := response.Unmarshal(packet.Data); err != nil {
+				return 0, err
+			}
 		}
+		return response.GroupID, nil
+	case protocol.StatusNotFound:
+		return 0, errors.New("The invitation expired")
+	default:
+		return 0, errors.New("Server error")
+	}
+}
+
+// groupChanged shows the new name and topic of a group, a deleted group
+// stays in the contacts with its history
+func groupChanged(push protocol.GroupChanged) {
+	name := push.Name
+	if push.Deleted {
+		name += " (deleted)"
+		delete(groupTopics, push.GroupID)
+	} else {
+		groupTopics[push.GroupID] = push.Topic
+	}
+	groupnames[push.GroupID] = name
+
+	key, chatEntry := getChatByID(push.GroupID, true)
+	if chatEntry == nil {
+		return
+	}
+	chatEntry.verbose = name
+	setContactText(chat{chatEntry.group, chatEntry.verbose, key, make([]message, 0), chatEntry.online})
+	if key == activeChat {
+		showChatHeader()
+	}
+}
 
+// showChatHeader shows the name of the active chat with the topic of a group
+func showChatHeader() {
+	chatEntry := chats[activeChat]
+	if chatEntry == nil {
+		chatHeader.SetText("")
+		return
+	}
+	text := chatEntry.verbose
+	if topic := groupTopics[chatEntry.id]; chatEntry.group && topic != "" {
+		text += " — " + topic
 	}
+	chatHeader.SetText(text)
+}
+
+// showSystemText adds a reply of the System, which is not stored on the
+// server, to the active chat
+func showSystemText(text string) {
+	chatEntry := chats[activeChat]
+	now := time.Now()
+	row, _ := createRow(1, "System", text, true, now)
+	chatEntry.messages = append(chatEntry.messages, message{1, "System", text, row, 0, protocol.ReceiptSent, nil, now})
+	chats[activeChat] = chatEntry
+
+	messageOutput.Add(row)
+	messageOutput.ShowAll()
+	scrollDown()
 }
 
 func clearText() {
@@ -969,85 +1436,152 @@ func addContact(isGroup int, contactName string, id uint64) error {
 }
 
 func createGroup() error {
-	serial := createSerializer()
 	text, _ := groupNameEntry.GetText()
 
 	if text == "" {
 		return errors.New("Empty line")
 	}
 
-	err := serial.String(text, 1)
+	request := protocol.CreateGroupRequest{Name: text, Public: groupPublic.GetActive()}
+	data, err := request.Marshal()
 	if err != nil {
 		return err
 	}
 
-	err = sendPacket(connection, 2, serial.buffer.Bytes())
+	packet, err := commands.Request(protocol.OpCreateGroup, data, 5*time.Second)
 	if err != nil {
 		return err
 	}
-
-	err, dataLen, opCode, buf := readPacket(connection, 5)
-	if err != nil {
-		return err
-	}
-	switch opCode {
-	case 200:
-		parser := parserStruct{buf, dataLen, 0}
-		id, err := parser.UInt64()
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		var response protocol.CreateGroupResponse
+		err := response.Unmarshal(packet.Data)
 		if err != nil {
 			return errors.New("Parse error: " + err.Error())
 		}
+		id := response.GroupID
 		groupname, err := getGroupname(id)
 		if err != nil {
 			return errors.New("Get error: " + err.Error())
 		}
 		addContact(1, groupname, id)
-	case 400:
+	case protocol.StatusBadRequest:
 		return errors.New("400: Bad syntax")
-	case 500:
+	case protocol.StatusServerError:
 		return errors.New("500: Server error")
-	case 409:
+	case protocol.StatusConflict:
 		return errors.New("409: Conflict. Group with this name already exists")
 	}
 
 	return nil
 }
 
+// searchGroups fills the browse window with the public groups matching the
+// search text
+func searchGroups() error {
+	if commands == nil {
+		return errors.New("Not connected")
+	}
+	text, _ := groupSearch.GetText()
+	request := protocol.SearchGroupsRequest{Query: text}
+	data, err := request.Marshal()
+	if err != nil {
+		return err
+	}
+
+	packet, err := commands.Request(protocol.OpSearchGroups, data, 5*time.Second)
+	if err != nil {
+		return errors.New("Server is not responding")
+	}
+	if packet.OpCode != protocol.StatusOK {
+		return errors.New("Server error")
+	}
+	var response protocol.SearchGroupsResponse
+	if err := response.Unmarshal(packet.Data); err != nil {
+		return errors.New("Parse error: " + err.Error())
+	}
+
+	for _, row := range foundRows {
+		groupResults.Remove(row)
+	}
+	foundGroups = response.Groups
+	foundRows = nil
+	for _, group := range foundGroups {
+		row, _ := gtk.ListBoxRowNew()
+		label, _ := gtk.LabelNew(group.Name + " (" + strconv.Itoa(int(group.Members)) + ")")
+		label.SetXAlign(0)
+		label.SetMarginStart(10)
+		label.SetMarginTop(8)
+		label.SetMarginBottom(8)
+		label.SetEllipsize(pango.ELLIPSIZE_END)
+		row.Add(label)
+		groupResults.Add(row)
+		foundRows = append(foundRows, row)
+	}
+	groupResults.ShowAll()
+	return nil
+}
+
+// joinGroup makes the user a member of a public group and opens its chat
+func joinGroup(group protocol.GroupInfo) error {
+	if commands == nil {
+		return errors.New("Not connected")
+	}
+	request := protocol.JoinGroupRequest{GroupID: group.GroupID}
+	data, err := request.Marshal()
+	if err != nil {
+		return err
+	}
+
+	packet, err := commands.Request(protocol.OpJoinGroup, data, 5*time.Second)
+	if err != nil {
+		return errors.New("Server is not responding")
+	}
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		addContact(1, group.Name, group.GroupID) // Fails if the hello of the group came first
+		return nil
+	case protocol.StatusNotFound:
+		return errors.New("404: The group doesn't exist")
+	case protocol.StatusForbidden:
+		return errors.New("403: The group is private")
+	case protocol.StatusConflict:
+		return errors.New("409: You are already in the group")
+	default:
+		return errors.New("Server error")
+	}
+}
+
 func getGroupname(id uint64) (string, error) {
 	if v, ok := groupnames[id]; ok {
 		return v, nil
 	}
 
-	serial := createSerializer()
-	serial.UInt64(id)
+	request := protocol.GroupNameRequest{GroupID: id}
+	data, _ := request.Marshal()
 
-	err := sendPacket(connection, 3, serial.buffer.Bytes())
+	packet, err := commands.Request(protocol.OpGroupName, data, 5*time.Second)
 	if err != nil {
 		return "", err
 	}
 
-	err, len, opCode, recieved := readPacket(connection, 0)
-
-	switch opCode {
-	case 200:
-		parser := parserStruct{recieved, len, 0}
-		nLen, err := parser.Byte()
-		if err != nil {
-			return "", err
-		}
-		contactName, err := parser.String(uint16(nLen))
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		var response protocol.NameResponse
+		err := response.Unmarshal(packet.Data)
 		if err != nil {
 			return "", err
 		}
+		contactName := response.Name
 		groupnames[id] = contactName
 
 		return contactName, nil
-	case 404:
+	case protocol.StatusNotFound:
 		return "", errors.New("404: Not found. \nUser doesn't exists")
-	case 400:
+	case protocol.StatusBadRequest:
 		return "", errors.New("400: Bad request")
 	default:
-		return "", errors.New(fmt.Sprint("Unhandled server response - ", opCode))
+		return "", errors.New(fmt.Sprint("Unhandled server response - ", packet.OpCode))
 	}
 }
 
@@ -1056,43 +1590,35 @@ func getUserID(contactName string) (uint64, error) {
 		return v, nil
 	}
 
-	var (
-		buffer bytes.Buffer
-	)
-
-	contactNameB := []byte(contactName)
-	length := len(contactNameB)
-
-	if length > 255 || length < 0 {
-		return 0, errors.New("Name is too big")
+	request := protocol.UserIDRequest{Username: contactName}
+	data, err := request.Marshal()
+	if err != nil {
+		return 0, err
 	}
 
-	buffer.WriteByte(byte(length))
-	buffer.Write(contactNameB)
-
-	err := sendPacket(connection, 6, buffer.Bytes())
+	packet, err := commands.Request(protocol.OpUserID, data, 5*time.Second)
 	if err != nil {
 		return 0, err
 	}
 
-	err, len, opCode, recieved := readPacket(connection, 0)
-
-	switch opCode {
-	case 200:
-		if len != 8 {
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		var response protocol.UserIDResponse
+		err := response.Unmarshal(packet.Data)
+		if err != nil {
 			return 0, errors.New("Bad response")
 		}
-		userID := binary.LittleEndian.Uint64(recieved)
+		userID := response.UserID
 		userids[contactName] = userID
 		usernames[userID] = contactName
 
 		return userID, nil
-	case 404:
+	case protocol.StatusNotFound:
 		return 0, errors.New("404: Not found. \nUser doesn't exists")
-	case 400:
+	case protocol.StatusBadRequest:
 		return 0, errors.New("400: Bad request")
 	default:
-		return 0, errors.New(fmt.Sprint("Unhandled server response - ", opCode))
+		return 0, errors.New(fmt.Sprint("Unhandled server response - ", packet.OpCode))
 	}
 }
 
@@ -1101,191 +1627,207 @@ func getUsername(id uint64) (string, error) {
 		return v, nil
 	}
 
-	serial := createSerializer()
-	serial.UInt64(id)
+	request := protocol.UsernameRequest{UserID: id}
+	data, _ := request.Marshal()
 
-	err := sendPacket(connection, 7, serial.buffer.Bytes())
+	packet, err := commands.Request(protocol.OpUsername, data, 5*time.Second)
 	if err != nil {
 		return "", err
 	}
 
-	err, len, opCode, recieved := readPacket(connection, 0)
-
-	switch opCode {
-	case 200:
-		parser := parserStruct{recieved, len, 0}
-		nLen, err := parser.Byte()
-		if err != nil {
-			return "", err
-		}
-		contactName, err := parser.String(uint16(nLen))
+	switch packet.OpCode {
+	case protocol.StatusOK:
+		var response protocol.NameResponse
+		err := response.Unmarshal(packet.Data)
 		if err != nil {
 			return "", err
 		}
+		contactName := response.Name
 		userids[contactName] = id
 		usernames[id] = contactName
 
 		return contactName, nil
-	case 404:
+	case protocol.StatusNotFound:
 		return "", errors.New("404: Not found. \nUser doesn't exists")
-	case 400:
+	case protocol.StatusBadRequest:
 		return "", errors.New("400: Bad request")
 	default:
-		return "", errors.New(fmt.Sprint("Unhandled server response - ", opCode))
+		return "", errors.New(fmt.Sprint("Unhandled server response - ", packet.OpCode))
 	}
 }
 
+// senderName returns the name of the sender of a message, the messages of
+// deleted accounts stay in the history without one
+func senderName(id uint64) string {
+	name, err := getUsername(id)
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return "Deleted user"
+	}
+	return name
+}
+
 func listenMessages() {
-	var (
-		err     error
-		dataLen uint16
-		opCode  uint16
-		data    []byte
-	)
 	for {
-		if !online {
+		if !online || events == nil {
 			if !gtkAlive {
 				return
 			}
+			if sessionToken != "" {
+				err := resumeSession()
+				if err == nil {
+					continue
+				}
+				log.Println("Error: Can't resume the session: " + err.Error())
+				time.Sleep(5 * time.Second)
+				continue
+			}
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		if subscribtion == nil {
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		err, dataLen, opCode, data = readPacket(subscribtion, 0)
-		if err != nil {
+		select {
+		case packet := <-pushes:
+			handlePush(packet)
+		case <-events.Done():
 			log.Println("Error: Subscription fail")
 			setOnline(false)
-			continue
 		}
-		switch opCode {
-		case 1:
-			parser := parserStruct{data, dataLen, 0}
-			senderID, err := parser.UInt64()
-			if err != nil {
-				fmt.Printf("Error: " + err.Error())
-				break
+	}
+}
+
+func handlePush(packet *protocol.Packet) {
+	switch packet.OpCode {
+	case protocol.OpMessage:
+		var push protocol.Message
+		err := push.Unmarshal(packet.Data)
+		if err != nil {
+			fmt.Printf("Error: " + err.Error())
+			break
+		}
+		senderID, userID, groupID, msg := push.SenderID, push.UserID, push.GroupID, push.Text
+		if userID != 0 {
+			// Messages sent from the other devices of the user belong to the chat with the recipient
+			partnerID := senderID
+			if senderID == clID {
+				partnerID = userID
 			}
-			userID, err := parser.UInt64()
-			if err != nil {
-				fmt.Printf("Error: " + err.Error())
-				break
+			username := senderName(senderID)
+			partnerName := senderName(partnerID)
+			row, status := createRow(senderID, username, msg, false, push.Time())
+			_, destChat := getChatByID(partnerID, false)
+			if destChat == nil {
+				chatCount++
+				addToContactLists(0, chatCount, partnerID, partnerName)
 			}
-			groupID, err := parser.UInt64() //groupID
-			if err != nil {
-				fmt.Printf("Error: " + err.Error())
+			key, destChat := getChatByID(partnerID, false)
+			if hasMessage(destChat, push.MessageID) {
+				// Pushed again because the acknowledgement was lost
+				acknowledgeMessage(key, senderID, push.MessageID)
 				break
 			}
-			mLen, err := parser.UInt16()
-			if err != nil {
-				fmt.Printf("Error: " + err.Error())
-				break
+			state := acknowledgeMessage(key, senderID, push.MessageID)
+			destChat.messages = append(destChat.messages, message{senderID, username, msg, row, push.MessageID, state, status, push.Time()})
+			if key == activeChat {
+				messageOutput.Add(row)
+				messageOutput.ShowAll()
+
+				glib.IdleAdd(scrollDown, nil)
+			} else {
+				newMCounters[key]++
+				glib.IdleAdd(setContactText, chat{destChat.group, destChat.verbose, key, make([]message, 0), destChat.online})
 			}
-			msg, err := parser.String(mLen)
+			chats[key] = destChat
+		} else {
+			username := senderName(senderID)
+			groupname, err := getGroupname(groupID)
 			if err != nil {
-				fmt.Printf("Error: " + err.Error())
+				// The last message of a deleted group reaches the members who were offline
+				groupname = "Deleted group"
+			}
+			_, destChat := getChatByID(groupID, true)
+			if destChat == nil {
+				chatCount++
+				addToContactLists(1, chatCount, groupID, groupname)
+			}
+			key, destChat := getChatByID(groupID, true)
+			if hasMessage(destChat, push.MessageID) {
+				// Pushed again because the acknowledgement was lost
+				acknowledgeMessage(key, senderID, push.MessageID)
 				break
 			}
-			if userID != 0 {
-				username, err := getUsername(senderID)
-				if err != nil {
-					fmt.Printf("Error: " + err.Error())
-					break
-				}
-				row := createRow(senderID, username, msg, false)
-				_, destChat := getChatByID(senderID, false)
-				if destChat == nil {
-					chatCount++
-					addToContactLists(0, chatCount, senderID, username)
-				}
-				key, destChat := getChatByID(senderID, false)
-				destChat.messages = append(destChat.messages, message{senderID, username, msg, row})
-				if key == activeChat {
-					messageOutput.Add(row)
-					messageOutput.ShowAll()
-
-					glib.IdleAdd(scrollDown, nil)
+			var (
+				row    *gtk.ListBoxRow
+				status *gtk.Label
+			)
+			chatLen := len(destChat.messages)
+			if chatLen != 0 {
+				if destChat.messages[chatLen-1].senderID == senderID {
+					row, status = createRow(senderID, username, msg, false, push.Time())
 				} else {
-					newMCounters[key]++
-					glib.IdleAdd(setContactText, chat{destChat.group, destChat.verbose, key, make([]message, 0), destChat.online})
+					row, status = createRow(senderID, username, msg, true, push.Time())
 				}
-				chats[key] = destChat
 			} else {
-				if senderID == clID {
-					break
-				}
-				username, err := getUsername(senderID)
-				if err != nil {
-					fmt.Printf("Error: " + err.Error())
-					break
-				}
-				groupname, err := getGroupname(groupID)
-				if err != nil {
-					fmt.Printf("Error: " + err.Error())
-					break
-				}
-				_, destChat := getChatByID(groupID, true)
-				if destChat == nil {
-					chatCount++
-					addToContactLists(1, chatCount, groupID, groupname)
-				}
-				key, destChat := getChatByID(groupID, true)
-				var row *gtk.ListBoxRow
-				chatLen := len(destChat.messages)
-				if chatLen != 0 {
-					if destChat.messages[chatLen-1].senderID == senderID {
-						row = createRow(senderID, username, msg, false)
-					} else {
-						row = createRow(senderID, username, msg, true)
-					}
-				} else {
-					row = createRow(senderID, username, msg, true)
-				}
-				destChat.messages = append(destChat.messages, message{senderID, username, msg, row})
-				if key == activeChat {
-					messageOutput.Add(row)
-					messageOutput.ShowAll()
-
-					glib.IdleAdd(scrollDown, nil)
-				} else {
-					newMCounters[key]++
-					glib.IdleAdd(setContactText, chat{destChat.group, destChat.verbose, key, make([]message, 0), destChat.online})
-				}
-				chats[key] = destChat
-			}
-		case 8:
-			parser := parserStruct{data, dataLen, 0}
-			idCount, err := parser.UInt16()
-			if err != nil {
-				continue
+				row, status = createRow(senderID, username, msg, true, push.Time())
 			}
-			var id uint64
-			var i uint16
-			var online byte
-			for i = 0; i < idCount; i++ {
-				id, err = parser.UInt64()
-				if err != nil {
-					continue
-				}
-
-				online, err = parser.Byte()
-				if err != nil {
-					continue
-				}
+			state := acknowledgeMessage(key, senderID, push.MessageID)
+			destChat.messages = append(destChat.messages, message{senderID, username, msg, row, push.MessageID, state, status, push.Time()})
+			if key == activeChat {
+				messageOutput.Add(row)
+				messageOutput.ShowAll()
 
-				key, destChat := getChatByID(id, false)
-				if destChat == nil {
+				glib.IdleAdd(scrollDown, nil)
+			} else {
+				newMCounters[key]++
+				glib.IdleAdd(setContactText, chat{destChat.group, destChat.verbose, key, make([]message, 0), destChat.online})
+			}
+			chats[key] = destChat
+		}
+	case protocol.OpReceipt:
+		var push protocol.Receipt
+		err := push.Unmarshal(packet.Data)
+		if err != nil {
+			return
+		}
+		for _, chatEntry := range chats {
+			for i := range chatEntry.messages {
+				msg := &chatEntry.messages[i]
+				if msg.id != push.MessageID || msg.senderID != clID {
 					continue
 				}
-				if online == 1 {
-					destChat.online = true
-				} else {
-					destChat.online = false
+				if push.State > msg.state {
+					msg.state = push.State
+					glib.IdleAdd(setReceiptText, msg.status, msg.state)
 				}
-				glib.IdleAdd(setContactText, chat{destChat.group, destChat.verbose, key, make([]message, 0), destChat.online})
+				return
+			}
+		}
+	case protocol.OpInvite:
+		var push protocol.Invite
+		err := push.Unmarshal(packet.Data)
+		if err != nil {
+			return
+		}
+		glib.IdleAdd(showInvite, push)
+	case protocol.OpGroupChanged:
+		var push protocol.GroupChanged
+		err := push.Unmarshal(packet.Data)
+		if err != nil {
+			return
+		}
+		glib.IdleAdd(groupChanged, push)
+	case protocol.OpCheckOnline:
+		var push protocol.CheckOnlineResponse
+		err := push.Unmarshal(packet.Data)
+		if err != nil {
+			return
+		}
+		for _, status := range push.Users {
+			key, destChat := getChatByID(status.UserID, false)
+			if destChat == nil {
+				continue
 			}
+			destChat.online = status.Online
+			glib.IdleAdd(setContactText, chat{destChat.group, destChat.verbose, key, make([]message, 0), destChat.online})
 		}
 	}
 }
@@ -1294,37 +1836,58 @@ func listenMessages() {
 // etc
 //
 
-func onlineChecker() {
-	for {
-		if !online {
-			if !gtkAlive {
-				return
-			}
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		time.Sleep(5 * time.Second)
-		ids := make([]uint64, 0)
-		for _, value := range chats {
-			if value.group == false {
-				ids = append(ids, value.id)
-			}
+// acknowledgeMessage tells the server that a message pushed to chat key was
+// received, or read if the chat is open. Own messages are not acknowledged.
+// Returns the acknowledged state.
+func acknowledgeMessage(key, senderID, id uint64) byte {
+	if id == 0 || senderID == clID {
+		return protocol.ReceiptSent
+	}
+	state := protocol.ReceiptDelivered
+	if key == activeChat {
+		state = protocol.ReceiptRead
+	}
+	acknowledge(state, []uint64{id})
+	return state
+}
+
+func acknowledge(state byte, ids []uint64) {
+	if len(ids) == 0 || commands == nil {
+		return
+	}
+	request := protocol.AckRequest{State: state, MessageIDs: ids}
+	data, err := request.Marshal()
+	if err != nil {
+		return
+	}
+	commands.Send(protocol.OpAck, data)
+}
+
+// watchContacts asks once for the online state of the contacts, the server
+// pushes their changes afterwards
+func watchContacts() {
+	ids := make([]uint64, 0)
+	for _, value := range chats {
+		if value.group == false {
+			ids = append(ids, value.id)
 		}
-		glib.IdleAdd(checkOnline, ids)
 	}
+	checkOnline(ids)
 }
 
 func checkOnline(ids []uint64) {
-	serial := createSerializer()
-	serial.UInt16(uint16(len(ids)))
-	var i uint16
-	for i = 0; i < uint16(len(ids)); i++ {
-		serial.UInt64(ids[i])
+	if len(ids) == 0 {
+		return
 	}
-	if connection == nil {
+	request := protocol.CheckOnlineRequest{UserIDs: ids}
+	data, err := request.Marshal()
+	if err != nil {
+		return
+	}
+	if commands == nil {
 		return
 	}
-	sendPacket(connection, 8, serial.buffer.Bytes())
+	commands.Send(protocol.OpCheckOnline, data)
 }
 
 func setContactText(crutch chat) {
@@ -1408,6 +1971,9 @@ func addToContactLists(isGroup int, chatID, ID uint64, verbose string) {
 	сontactsList.Insert(row, 0)
 	glib.IdleAdd(setContactText, chat{chats[chatID].group, chats[chatID].verbose, chatID, make([]message, 0), chats[chatID].online})
 	сontactsList.ShowAll()
+	if isGroup == 0 {
+		checkOnline([]uint64{ID})
+	}
 }
 
 func redrawChat(prev, next uint64) { //, isPreviousChatGroup bool) {
@@ -1424,10 +1990,12 @@ func redrawChat(prev, next uint64) { //, isPreviousChatGroup bool) {
 	}
 
 	newMCounters[next] = 0
+	loadHistory(next)
 
 	glib.IdleAdd(setContactText, chat{chats[next].group, chats[next].verbose, next, make([]message, 0), chats[next].online})
 
 	chatNextMsg := chats[next].messages
+	unread := make([]uint64, 0)
 
 	for i := range chatNextMsg {
 		row := chatNextMsg[i].row
@@ -1436,19 +2004,169 @@ func redrawChat(prev, next uint64) { //, isPreviousChatGroup bool) {
 		messageOutput.ShowAll()
 
 		chatNextMsg[i].row = row
+		if chatNextMsg[i].senderID != clID && chatNextMsg[i].id != 0 && chatNextMsg[i].state < protocol.ReceiptRead {
+			chatNextMsg[i].state = protocol.ReceiptRead
+			unread = append(unread, chatNextMsg[i].id)
+		}
 	}
+	acknowledge(protocol.ReceiptRead, unread)
 	scrollDown()
 }
 
+// loadHistory merges the stored messages of a chat with the messages
+// received since the start, the first time the chat is opened after the
+// start or a resume of the session
+func loadHistory(key uint64) {
+	chatEntry := chats[key]
+	if historyDone[key] || chatEntry == nil || commands == nil {
+		return
+	}
+	entries, ok := requestHistory(chatEntry, 0)
+	if !ok {
+		return
+	}
+	historyDone[key] = true
+	historyMore[key] = len(entries) == HISTORYPAGESIZE
+	history := historyMessages(chatEntry, entries)
+
+	// Both are in the order of sending, messages without a time are put
+	// after the history
+	merged := make([]message, 0, len(history)+len(chatEntry.messages))
+	next := 0
+	for _, msg := range chatEntry.messages {
+		for next < len(history) && (msg.sent.IsZero() || history[next].sent.Before(msg.sent)) {
+			merged = append(merged, history[next])
+			next++
+		}
+		merged = append(merged, msg)
+	}
+	chatEntry.messages = append(merged, history[next:]...)
+}
+
+// loadOlderHistory puts the stored messages sent before the oldest loaded
+// one at the top of the chat, when it is scrolled to the top
+func loadOlderHistory(key uint64) {
+	chatEntry := chats[key]
+	if !historyDone[key] || !historyMore[key] || chatEntry == nil || commands == nil {
+		return
+	}
+	var oldest uint64
+	for _, msg := range chatEntry.messages {
+		if msg.id != 0 && (oldest == 0 || msg.id < oldest) {
+			oldest = msg.id
+		}
+	}
+	if oldest == 0 {
+		return
+	}
+	entries, ok := requestHistory(chatEntry, oldest)
+	if !ok {
+		return
+	}
+	historyMore[key] = len(entries) == HISTORYPAGESIZE
+	older := historyMessages(chatEntry, entries)
+
+	if key == activeChat {
+		unread := make([]uint64, 0)
+		for i := range older {
+			messageOutput.Insert(older[i].row, i)
+			if older[i].senderID != clID && older[i].state < protocol.ReceiptRead {
+				older[i].state = protocol.ReceiptRead
+				unread = append(unread, older[i].id)
+			}
+		}
+		messageOutput.ShowAll()
+		acknowledge(protocol.ReceiptRead, unread)
+	}
+	chatEntry.messages = append(older, chatEntry.messages...)
+}
+
+// requestHistory returns a page of the stored messages of a chat, the newest
+// ones or the ones sent before beforeID
+func requestHistory(chatEntry *chat, beforeID uint64) ([]protocol.HistoryEntry, bool) {
+	request := protocol.HistoryRequest{BeforeID: beforeID, Limit: HISTORYPAGESIZE}
+	if chatEntry.group {
+		request.GroupID = chatEntry.id
+	} else {
+		request.UserID = chatEntry.id
+	}
+	data, _ := request.Marshal()
+
+	packet, err := commands.Request(protocol.OpHistory, data, 5*time.Second)
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return nil, false
+	}
+	if packet.OpCode != protocol.StatusOK {
+		fmt.Println("History is not available:", packet.OpCode)
+		return nil, false
+	}
+	var response protocol.HistoryResponse
+	err = response.Unmarshal(packet.Data)
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return nil, false
+	}
+	return response.Messages, true
+}
+
+// historyMessages creates the rows of the stored messages the chat doesn't
+// have yet
+func historyMessages(chatEntry *chat, entries []protocol.HistoryEntry) []message {
+	known := make(map[uint64]bool)
+	for _, msg := range chatEntry.messages {
+		known[msg.id] = true
+	}
+	history := make([]message, 0, len(entries))
+	var prevSender uint64
+	for _, entry := range entries {
+		if known[entry.MessageID] {
+			continue
+		}
+		name := clUsername
+		if entry.SenderID != clID {
+			name = senderName(entry.SenderID)
+		}
+		includeName := chatEntry.group && entry.SenderID != prevSender && entry.SenderID != clID
+		prevSender = entry.SenderID
+		row, status := createRow(entry.SenderID, name, entry.Text, includeName, entry.Time())
+		setReceiptText(status, entry.State)
+		history = append(history, message{entry.SenderID, name, entry.Text, row, entry.MessageID, entry.State, status, entry.Time()})
+	}
+	return history
+}
+
+// hasMessage reports whether the chat already has the message, which comes
+// again from the offline queue or the history after a reconnect
+func hasMessage(chatEntry *chat, id uint64) bool {
+	if id == 0 {
+		return false
+	}
+	for i := range chatEntry.messages {
+		if chatEntry.messages[i].id == id {
+			return true
+		}
+	}
+	return false
+}
+
 func scrollDown() {
 	adj, _ := gtk.AdjustmentNew(0xffffffff, 0, 0xffffffff, 0, 0, 0)
 	messageScroll.SetVAdjustment(adj)
 }
 
-func createRow(sender uint64, name string, str string, includeName bool) *gtk.ListBoxRow {
+// createRow returns the row of a message and, for own messages, the label
+// showing its delivery state
+func createRow(sender uint64, name string, str string, includeName bool, sent time.Time) (*gtk.ListBoxRow, *gtk.Label) {
 	row, _ := gtk.ListBoxRowNew()
 	box, _ := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 0)
 
+	var status *gtk.Label
+	if sender == clID {
+		status, _ = gtk.LabelNew("")
+		setReceiptText(status, protocol.ReceiptSent)
+	}
+
 	if includeName {
 		label, _ := gtk.LabelNew("")
 		label.SetXAlign(0)
@@ -1487,8 +2205,9 @@ func createRow(sender uint64, name string, str string, includeName bool) *gtk.Li
 					row.SetMarginEnd(250)
 				}
 				box.PackStart(image, true, true, 0)
+				packFooter(box, sender, sent, status)
 				row.Add(box)
-				return row
+				return row, status
 			}
 		}
 	}
@@ -1513,8 +2232,49 @@ func createRow(sender uint64, name string, str string, includeName bool) *gtk.Li
 	}
 
 	box.PackStart(label, true, true, 0)
+	packFooter(box, sender, sent, status)
 	row.Add(box)
-	return row
+	return row, status
+}
+
+// packFooter puts the time and the delivery state label under a message
+func packFooter(box *gtk.Box, sender uint64, sent time.Time, status *gtk.Label) {
+	if sent.IsZero() && status == nil {
+		return
+	}
+	footer, _ := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 6)
+	footer.SetMarginBottom(6)
+	if sender == clID {
+		footer.SetHAlign(gtk.ALIGN_END)
+		footer.SetMarginEnd(20)
+	} else {
+		footer.SetHAlign(gtk.ALIGN_START)
+		footer.SetMarginStart(20)
+	}
+	if !sent.IsZero() {
+		local := sent.Local()
+		timeLabel, _ := gtk.LabelNew(local.Format("15:04"))
+		timeLabel.SetTooltipText(local.Format("2006-01-02 15:04:05"))
+		footer.PackStart(timeLabel, false, false, 0)
+	}
+	if status != nil {
+		footer.PackStart(status, false, false, 0)
+	}
+	box.PackStart(footer, true, true, 0)
+}
+
+func setReceiptText(status *gtk.Label, state byte) {
+	if status == nil {
+		return
+	}
+	switch state {
+	case protocol.ReceiptDelivered:
+		status.SetText("✓✓")
+	case protocol.ReceiptRead:
+		status.SetText("✓✓ read")
+	default:
+		status.SetText("✓")
+	}
 }
 
 func scanStickers() {
@@ -1603,176 +2363,3 @@ func getChatByID(id uint64, isGroup bool) (uint64, *chat) {
 	}
 	return 0, nil
 }
-
-//
-//
-// Parser
-//
-//
-type parserStruct struct {
-	data   []byte
-	length uint16
-	offset uint16
-}
-
-func (obj *parserStruct) Byte() (byte, error) {
-	if obj.offset+1 > obj.length {
-		return 0, errors.New("Offset is out of range")
-	}
-	defer incrementOffset(1, obj)
-	return byte(obj.data[obj.offset]), nil
-}
-
-func (obj *parserStruct) UInt16() (uint16, error) {
-	if obj.offset+2 > obj.length {
-		return 0, errors.New("Offset is out of range")
-	}
-	defer incrementOffset(2, obj)
-	return binary.LittleEndian.Uint16(obj.data[obj.offset : obj.offset+2]), nil
-}
-
-func (obj *parserStruct) UInt32() (uint32, error) {
-	if obj.offset+4 > obj.length {
-		return 0, errors.New("Offset is out of range")
-	}
-	defer incrementOffset(4, obj)
-	return binary.LittleEndian.Uint32(obj.data[obj.offset : obj.offset+4]), nil
-}
-
-func (obj *parserStruct) UInt64() (uint64, error) {
-	if obj.offset+8 > obj.length {
-		return 0, errors.New("Offset is out of range")
-	}
-	defer incrementOffset(8, obj)
-	return binary.LittleEndian.Uint64(obj.data[obj.offset : obj.offset+8]), nil
-}
-
-func (obj *parserStruct) String(len uint16) (string, error) {
-	if obj.offset+len > obj.length {
-		return "", errors.New("Offset is out of range")
-	}
-	defer incrementOffset(len, obj)
-	return string(obj.data[obj.offset : obj.offset+len]), nil
-}
-
-func (obj *parserStruct) Chunk(len uint16) ([]byte, error) {
-	if obj.offset+len > obj.length {
-		return nil, errors.New("Offset is out of range")
-	}
-	defer incrementOffset(len, obj)
-	return obj.data[obj.offset : obj.offset+len], nil
-}
-
-func incrementOffset(count uint16, obj *parserStruct) {
-	obj.offset += count
-}
-
-//
-//
-// Serializer
-//
-//
-func createSerializer() serializerStruct {
-	var buffer bytes.Buffer
-	obj := serializerStruct{buffer}
-	return obj
-}
-
-type serializerStruct struct {
-	buffer bytes.Buffer
-}
-
-func (obj *serializerStruct) Byte(input byte) error {
-	err := obj.buffer.WriteByte(input)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (obj *serializerStruct) UInt16(input uint16) error {
-	temp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(temp, input)
-	_, err := obj.buffer.Write(temp)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (obj *serializerStruct) UInt32(input uint32) error {
-	temp := make([]byte, 4)
-	binary.LittleEndian.PutUint32(temp, input)
-	_, err := obj.buffer.Write(temp)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (obj *serializerStruct) UInt64(input uint64) error {
-	temp := make([]byte, 8)
-	binary.LittleEndian.PutUint64(temp, input)
-	_, err := obj.buffer.Write(temp)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (obj *serializerStruct) String(input string, lenLen int) error {
-	inputB := []byte(input)
-	len := len(inputB)
-	if lenLen == 1 {
-		if len > 255 {
-			return errors.New("String is too long")
-		}
-		err := obj.buffer.WriteByte(byte(len))
-		if err != nil {
-			return err
-		}
-	} else if lenLen == 2 {
-		if len > 65535 {
-			return errors.New("String is too long")
-		}
-		err := obj.UInt16(uint16(len))
-		if err != nil {
-			return err
-		}
-	} else {
-		err := obj.UInt32(uint32(len))
-		if err != nil {
-			return err
-		}
-	}
-	_, err := obj.buffer.Write(inputB)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (obj *serializerStruct) Chunk(input []byte, lenLen int) error {
-	len := len(input)
-	if lenLen == 1 {
-		err := obj.buffer.WriteByte(byte(len))
-		if err != nil {
-			return err
-		}
-	} else if lenLen == 2 {
-		err := obj.UInt16(uint16(len))
-		if err != nil {
-			return err
-		}
-	} else {
-		err := obj.UInt32(uint32(len))
-		if err != nil {
-			return err
-		}
-	}
-	_, err := obj.buffer.Write(input)
-	if err != nil {
-		return err
-	}
-	return nil
-}
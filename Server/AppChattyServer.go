@@ -1,32 +1,39 @@
 package main
 
 import (
-	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/Alex1ch/AppChatty/protocol"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type msgStruct struct {
-	client  net.Conn
-	message string
-	group   bool
-	ID      uint64
-	sender  uint64
+	client    *protocol.Conn // Session the message comes from or, for a reply of the System, goes to
+	message   string
+	group     bool
+	ID        uint64
+	sender    uint64
+	messageID uint64 // 0 for the replies to group commands
 }
 
 var (
-	users        map[uint64]net.Conn
-	subscription map[uint64]net.Conn
 	appDB        *gorm.DB
 	none, none64 []byte
 )
@@ -36,21 +43,52 @@ const (
 	ADDRESS = "0.0.0.0"
 	//PORT Listen port for the Server
 	PORT = "1237"
+	//TLSPORT Default listen port for TLS clients
+	TLSPORT = "1238"
 	//BUFFERSIZE Size of the tcp buffer
 	BUFFERSIZE = 1024
+	//MAXFRAMESIZE Biggest frame data accepted from authorized clients
+	MAXFRAMESIZE = protocol.MaxDataLen
+	//PREAUTHFRAMESIZE Biggest frame data accepted before the authorization, the credentials take at most 517 bytes
+	PREAUTHFRAMESIZE = 1024
+	//MAXMESSAGESIZE Biggest packet accepted from authorized clients after reassembly of fragments
+	MAXMESSAGESIZE = 1 << 20
+	//HISTORYPAGESIZE Biggest count of messages returned by a history request
+	HISTORYPAGESIZE = 100
+	//PASSWORDCOST bcrypt cost of the stored password hashes
+	PASSWORDCOST = 12
+	//TOKENLIFETIME Time after which a session token has to be replaced by the password
+	TOKENLIFETIME = 7 * 24 * time.Hour
+	//USERNAMEMINLEN USERNAMEMAXLEN Length limits of new usernames
+	USERNAMEMINLEN = 3
+	USERNAMEMAXLEN = 32
+	//PASSWORDMINLEN PASSWORDMAXLEN Length limits of new passwords, bcrypt uses only 72 bytes
+	PASSWORDMINLEN = 8
+	PASSWORDMAXLEN = 72
+)
+
+var errUserExists = errors.New("User already exists")
+
+// Password hash schemes of userStruct
+const (
+	hashSHA256 byte = 0 // Legacy unsalted SHA-256, upgraded on the next authentication
+	hashBcrypt byte = 1 // bcrypt, the salt and the cost are part of the hash
 )
 
 //DB Structures
 type userStruct struct {
 	ID       uint64 `gorm:"primary_key"`
-	Username string
+	Username string `gorm:"unique_index"`
 	Hash     []byte
+	Scheme   byte
 }
 
 type groupStruct struct {
 	ID      uint64 `gorm:"primary_key"`
 	OwnerID uint64
 	Verbose string
+	Public  bool   // Found by the search and joined without an invitation
+	Topic   string // Shown in the header of the chat
 }
 
 type groupMemberStruct struct {
@@ -58,9 +96,66 @@ type groupMemberStruct struct {
 	UserID   uint64
 	GroupID  uint64
 	Username string
+	Role     groupRole
+}
+
+type messageStruct struct {
+	ID        uint64 `gorm:"primary_key"`
+	SenderID  uint64 `gorm:"index"`
+	UserID    uint64 `gorm:"index"`
+	GroupID   uint64 `gorm:"index"`
+	Body      string
+	CreatedAt time.Time
+}
+
+// Session token, only its hash is stored
+type tokenStruct struct {
+	ID        uint64 `gorm:"primary_key"`
+	UserID    uint64 `gorm:"index"`
+	Hash      string `gorm:"unique_index"`
+	ExpiresAt time.Time
+}
+
+// Delivery state of a message for one of its recipients
+type receiptStruct struct {
+	ID        uint64 `gorm:"primary_key"`
+	MessageID uint64 `gorm:"index"`
+	UserID    uint64 `gorm:"index"`
+	State     byte
+	Queued    bool // Not pushed yet, the recipient was offline
 }
 
 func main() {
+	certFile := flag.String("cert", "", "TLS certificate file (PEM)")
+	keyFile := flag.String("key", "", "TLS private key file (PEM)")
+	tlsPort := flag.String("tls-port", TLSPORT, "Listen port for TLS clients")
+	tlsOnly := flag.Bool("tls-only", false, "Don't accept plain TCP clients")
+	genCert := flag.Bool("gen-cert", false, "Create a self-signed certificate at -cert and -key if it doesn't exist")
+	hosts := flag.String("hosts", "localhost,127.0.0.1", "Comma separated names and IPs of the self-signed certificate")
+	flag.IntVar(&outboxSize, "queue-size", OUTBOXSIZE, "Events queued for a subscribed connection")
+	flag.StringVar(&outboxPolicy, "queue-policy", policyDisconnect, "What to do with a full queue: disconnect or drop (the oldest event)")
+	flag.DurationVar(&inviteLifetime, "invite-lifetime", INVITELIFETIME, "Time an invitation to a group waits for the answer")
+	metrics := flag.String("metrics", "", "Address to serve the metrics on /debug/vars, e.g. 127.0.0.1:6060")
+	flag.Parse()
+
+	if outboxPolicy != policyDisconnect && outboxPolicy != policyDrop {
+		log.Fatal("Unknown queue policy ", outboxPolicy)
+	}
+	if outboxSize < 1 {
+		log.Fatal("Queue size must be positive")
+	}
+	if *metrics != "" {
+		go serveMetrics(*metrics)
+	}
+
+	var tlsConfig *tls.Config
+	if *certFile != "" || *keyFile != "" || *tlsOnly || *genCert {
+		var err error
+		tlsConfig, err = loadTLSConfig(*certFile, *keyFile, *genCert, *hosts)
+		if err != nil {
+			log.Fatal("TLS setup failed: ", err)
+		}
+	}
 
 	//Initialization
 	var err error
@@ -73,317 +168,399 @@ func main() {
 	appDB.AutoMigrate(&userStruct{})
 	appDB.AutoMigrate(&groupStruct{})
 	appDB.AutoMigrate(&groupMemberStruct{})
+	appDB.AutoMigrate(&messageStruct{})
+	appDB.AutoMigrate(&receiptStruct{})
+	appDB.AutoMigrate(&tokenStruct{})
+	appDB.AutoMigrate(&lockoutStruct{})
+	appDB.AutoMigrate(&inviteStruct{})
+	// Owners of the groups created before the roles
+	appDB.Exec("UPDATE group_member_structs SET role = ? WHERE role = ? AND user_id = (SELECT owner_id FROM group_structs WHERE group_structs.id = group_member_structs.group_id)", roleOwner, roleMember)
+	appDB.Delete(tokenStruct{}, "expires_at < ?", time.Now())
+	appDB.Delete(inviteStruct{}, "expires_at < ?", time.Now())
 	appDB.Create(&userStruct{Username: "System", Hash: []byte{0, 0, 0, 0}, ID: 1})
-	subscription = make(map[uint64]net.Conn)
-	users = make(map[uint64]net.Conn)
 
 	//ListenStart
-	listenClient(ADDRESS, PORT)
+	if tlsConfig == nil {
+		listenClient(ADDRESS, PORT)
+	} else if *tlsOnly {
+		listenClientTLS(ADDRESS, *tlsPort, tlsConfig)
+	} else {
+		go listenClientTLS(ADDRESS, *tlsPort, tlsConfig)
+		listenClient(ADDRESS, PORT)
+	}
 }
 
-func handlePacket(clID uint64, client net.Conn) {
-	var (
-		err     error
-		dataLen uint16
-		opCode  uint16
-		buffer  []byte
-	)
-
+func handlePacket(clID uint64, client *protocol.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go heartbeat(client, done)
 	for {
-		client.SetReadDeadline(time.Time{})
-		err, dataLen, opCode, buffer = readPacket(client, 0) // For some reason, timeout doesn't work
+		// A peer which misses its pings is dropped, so it doesn't stay online
+		packet, err := client.ReadPacket(protocol.IdleTimeout)
+		if err == protocol.ErrMessageTooLarge {
+			client.Reply(packet, protocol.StatusPayloadTooLarge, nil)
+			continue
+		}
 		if err != nil {
 			log.Println(err.Error())
-			client.Close()
-			if subscription[clID] != nil {
-				subscription[clID].Close()
-				subscription[clID] = nil
-			}
-
-			if users[clID] != nil {
-				users[clID].Close()
-				users[clID] = nil
+			if registry.remove(clID, client) {
+				go presenceChanged(clID)
 			}
 			return
 		}
-		switch opCode {
-		case 1:
-			parser := parserStruct{buffer, dataLen, 0}
-			senderID, err := parser.UInt64()
+		switch packet.OpCode {
+		case protocol.OpMessage:
+			var request protocol.Message
+			err := request.Unmarshal(packet.Data)
 			if err != nil {
-				sendPacket(client, 400, nil)
-				continue
-			}
-			userID, err := parser.UInt64()
-			if err != nil {
-				sendPacket(client, 400, nil)
-				continue
-			}
-			groupID, err := parser.UInt64()
-			if err != nil {
-				sendPacket(client, 400, nil)
-				continue
-			}
-			msgLen, err := parser.UInt16()
-			if err != nil {
-				sendPacket(client, 400, nil)
-				continue
-			}
-			msg, err := parser.String(msgLen)
-			if err != nil {
-				sendPacket(client, 400, nil)
+				client.Reply(packet, protocol.StatusBadRequest, nil)
 				continue
 			}
+			userID, groupID, msg := request.UserID, request.GroupID, request.Text
 
 			var msgObj msgStruct
-			var groupMem groupMemberStruct
 			if userID != 0 {
 				var user userStruct
 				appDB.First(&user, "id = ?", userID)
 				if reflect.DeepEqual(user, userStruct{}) {
-					sendPacket(client, 404, nil)
+					client.Reply(packet, protocol.StatusNotFound, nil)
 					continue
 				}
-				sendPacket(client, 200, nil)
-				msgObj = msgStruct{users[userID], msg, false, userID, senderID}
+				msgObj = msgStruct{client, msg, false, userID, clID, 0}
+				msgObj.messageID = storeMessage(clID, userID, 0, msg)
+				if msgObj.messageID == 0 {
+					replyMessageID(client, packet, 0, protocol.StatusOK)
+				}
 			} else {
 				var group groupStruct
 				appDB.First(&group, "id = ?", groupID)
 				if reflect.DeepEqual(group, groupStruct{}) {
-					sendPacket(client, 404, nil)
+					client.Reply(packet, protocol.StatusNotFound, nil)
 					continue
 				}
-				sendPacket(client, 200, nil)
-
-				msgObj = msgStruct{nil, msg, true, groupID, senderID}
-
-				if len(msg) > 5 {
-					if msg[:6] == "/leave" {
-						if clID == group.OwnerID {
-							go sendSystemMessageToUserInGroup(&msgStruct{nil, "You can't leave group without owner, use /grant and then /leave", true, groupID, 1}, clID)
-							continue
-						} else {
-							appDB.First(&groupMem, "group_id = ? AND user_id = ?", groupID, clID)
-							if groupMem.ID != 0 {
-								appDB.Delete(groupMemberStruct{}, "group_id = ? AND user_id = ?", groupID, clID)
-								msgObj = msgStruct{nil, groupMem.Username + " left the group", true, groupID, 1}
-							} else {
-								go sendSystemMessageToUserInGroup(&msgStruct{nil, "You are not in the group", true, groupID, 1}, clID)
-								continue
-							}
-						}
-					}
-					if msg[:5] == "/add " {
-						username := msg[5:]
-
-						if group.OwnerID != clID {
-							go sendSystemMessageToUserInGroup(&msgStruct{nil, "You aren't owner of this group", true, groupID, 1}, clID)
-							continue
-						}
-
-						addID, err := getUserIDbyName([]byte(username))
-						if err != nil {
-							go sendSystemMessageToUserInGroup(&msgStruct{nil, username + " is doesn't exists", true, groupID, 1}, clID)
-							continue
-						} else {
-							appDB.First(&groupMem, "group_id = ? AND user_id = ?", groupID, addID)
-							if groupMem.ID == 0 {
-								appDB.Create(&groupMemberStruct{UserID: addID, GroupID: group.ID, Username: username})
-								msgObj = msgStruct{nil, username + " was added to the group", true, groupID, 1}
-							} else {
-								go sendSystemMessageToUserInGroup(&msgStruct{nil, username + " already in group", true, groupID, 1}, clID)
-								continue
-							}
-						}
+				if command, args := parseCommand(msg); command != nil {
+					replyMessageID(client, packet, 0, protocol.StatusOK)
+					ctx, err := runCommand(command, clID, client, groupID, args)
+					for _, reply := range commandReplies(ctx, err) {
+						sendSystemMessageToUserInGroup(&msgStruct{client, reply, true, groupID, 1, 0}, clID)
 					}
+					continue
 				}
-
-				if len(msg) > 4 {
-					if msg[:5] == "/list" {
-						var iterId uint64
-						var iterUsername string
-						list := "List of users in group"
-						counter := 1
-						rows, err := appDB.Raw("SELECT user_id, username FROM group_member_structs WHERE group_id = " + strconv.FormatUint(groupID, 10)).Rows()
-
-						if err != nil {
-							fmt.Println(err.Error())
-							return
-						}
-						for rows.Next() {
-							err = rows.Scan(&iterId, &iterUsername)
-							list += "\n"
-							list += strconv.Itoa(counter) + ". "
-							if isOnline(iterId) {
-								list += " 🔵 "
-							} else {
-								list += " 🌑 "
-							}
-							list += iterUsername
-							if group.OwnerID == iterId {
-								list += " 👑"
-							}
-							counter++
-						}
-						go sendSystemMessageToUserInGroup(&msgStruct{nil, list, true, groupID, 1}, clID)
-						continue
-					}
+				msgObj = msgStruct{client, msg, true, groupID, clID, 0}
+				if isGroupMember(clID, groupID) {
+					msgObj.messageID = storeMessage(clID, 0, groupID, msg)
 				}
-
-				if len(msg) > 6 {
-
-					if msg[:6] == "/kick " {
-						username := msg[6:]
-
-						if group.OwnerID != clID {
-							go sendSystemMessageToUserInGroup(&msgStruct{nil, "You aren't owner of this group", true, groupID, 1}, clID)
-							continue
-						}
-
-						kickID, err := getUserIDbyName([]byte(username))
-						if err != nil {
-							go sendSystemMessageToUserInGroup(&msgStruct{nil, username + " is doesn't exists", true, groupID, 1}, clID)
-							continue
-						} else {
-							if kickID == clID {
-								go sendSystemMessageToUserInGroup(&msgStruct{nil, "You can't delete yourself, use /grant and then /leave", true, groupID, 1}, clID)
-								continue
-							}
-							appDB.First(&groupMem, "group_id = ? AND user_id = ?", groupID, kickID)
-							if groupMem.ID != 0 {
-								msgObj = msgStruct{nil, username + " was deleted from the group", true, groupID, 1}
-								go sendMessage(&msgObj)
-								appDB.Delete(groupMemberStruct{}, "group_id = ? AND user_id = ?", groupID, kickID)
-								continue
-							} else {
-								go sendSystemMessageToUserInGroup(&msgStruct{nil, username + " not in group", true, groupID, 1}, clID)
-								continue
-							}
-						}
-					}
+				if msgObj.messageID == 0 {
+					replyMessageID(client, packet, 0, protocol.StatusOK)
 				}
-				if len(msg) > 7 {
-					if msg[:7] == "/grant " {
-						username := msg[7:]
-
-						if group.OwnerID != clID {
-							go sendSystemMessageToUserInGroup(&msgStruct{nil, "You aren't owner of this group", true, groupID, 1}, clID)
-							continue
-						}
-						grantID, err := getUserIDbyName([]byte(username))
-						if err != nil {
-							go sendSystemMessageToUserInGroup(&msgStruct{nil, username + " is doesn't exists", true, groupID, 1}, clID)
-							continue
-						} else {
-							if grantID == clID {
-								go sendSystemMessageToUserInGroup(&msgStruct{nil, "You can't /grant to yourself", true, groupID, 1}, clID)
-								continue
-							} else {
-								appDB.First(&groupMem, "group_id = ? AND user_id = ?", groupID, grantID)
-								if groupMem.ID != 0 {
-									appDB.Model(&group).Update("owner_id", grantID)
-									msgObj = msgStruct{nil, username + " is now owner of the group", true, groupID, 1}
-								} else {
-									go sendSystemMessageToUserInGroup(&msgStruct{nil, username + " not in group", true, groupID, 1}, clID)
-									continue
-								}
-							}
-						}
-					}
-				}
-
 			}
 
-			go sendMessage(&msgObj)
+			if msgObj.messageID == 0 {
+				go sendMessage(&msgObj)
+				continue
+			}
+			// The sender learns whether everybody got the message or it waits in a queue
+			status := protocol.StatusOK
+			if sendMessage(&msgObj) {
+				status = protocol.StatusAccepted
+			}
+			replyMessageID(client, packet, msgObj.messageID, status)
 
-		case 2:
-			groupID, err := createGroup(clID, buffer, dataLen)
+		case protocol.OpCreateGroup:
+			groupID, err := createGroup(clID, packet.Data)
 			if err != nil {
 				if err.Error() == "409" {
-					sendPacket(client, 409, nil)
+					client.Reply(packet, protocol.StatusConflict, nil)
 					continue
 				} else {
-					sendPacket(client, 400, nil)
+					client.Reply(packet, protocol.StatusBadRequest, nil)
 					continue
 				}
 			}
 			if groupID == 0 {
-				sendPacket(client, 500, nil)
+				client.Reply(packet, protocol.StatusServerError, nil)
 				continue
 			} else {
-				serial := createSerializer()
-				err := serial.UInt64(groupID)
+				response := protocol.CreateGroupResponse{GroupID: groupID}
+				data, err := response.Marshal()
 				if err != nil {
-					sendPacket(client, 500, nil)
+					client.Reply(packet, protocol.StatusServerError, nil)
 					continue
 				}
-				sendPacket(client, 200, serial.buffer.Bytes())
+				client.Reply(packet, protocol.StatusOK, data)
 			}
-		case 3:
-			if len(buffer) != 8 {
-				sendPacket(client, 400, nil)
+		case protocol.OpGroupName:
+			var request protocol.GroupNameRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
 			}
-			groupname, err := getGroupNamebyID(binary.LittleEndian.Uint64(buffer))
+			groupname, err := getGroupNamebyID(request.GroupID)
 			if err != nil {
 				log.Println(err.Error())
-				sendPacket(client, 404, nil)
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
 			}
-			serial := createSerializer()
-			serial.String(groupname, 1)
-			sendPacket(client, 200, serial.buffer.Bytes())
-		case 6:
-			id, err := getUserIDbyName(buffer[1:])
+			response := protocol.NameResponse{Name: groupname}
+			data, _ := response.Marshal()
+			client.Reply(packet, protocol.StatusOK, data)
+		case protocol.OpUserID:
+			var request protocol.UserIDRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			id, err := getUserIDbyName([]byte(request.Username))
 			if err != nil {
 				log.Println(err.Error())
-				if err.Error() == "Bad format" {
-					sendPacket(client, 400, nil)
-				}
-				sendPacket(client, 404, nil)
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			}
+			response := protocol.UserIDResponse{UserID: id}
+			data, _ := response.Marshal()
+			client.Reply(packet, protocol.StatusOK, data)
+		case protocol.OpUsername:
+			var request protocol.UsernameRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			username, err := getNamebyUserID(request.UserID)
+			if err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			}
+			response := protocol.NameResponse{Name: username}
+			data, _ := response.Marshal()
+			client.Reply(packet, protocol.StatusOK, data)
+		case protocol.OpCheckOnline:
+			var request protocol.CheckOnlineRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				continue
 			}
-			idB := make([]byte, 8)
-			binary.LittleEndian.PutUint64(idB, id)
-			sendPacket(client, 200, idB)
-		case 7:
-			if len(buffer) != 8 {
-				sendPacket(client, 400, nil)
+			// The changes of these users are pushed from now on
+			watches.watch(clID, request.UserIDs)
+			var response protocol.CheckOnlineResponse
+			for _, id := range request.UserIDs {
+				response.Users = append(response.Users, protocol.OnlineStatus{UserID: id, Online: isOnline(id)})
 			}
-			username, err := getNamebyUserID(binary.LittleEndian.Uint64(buffer))
+			data, err := response.Marshal()
 			if err != nil {
+				continue
+			}
+
+			sendPacketToSessions(clID, client, nil, protocol.OpCheckOnline, data)
+
+		case protocol.OpGroupCommand:
+			var request protocol.GroupCommandRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			command, ok := groupCommands[request.Command]
+			if !ok {
+				replyError(client, packet, protocol.StatusNotFound, "Unknown command")
+				continue
+			}
+			ctx, err := runCommand(command, clID, client, request.GroupID, request.Args)
+			if commandErr, ok := err.(*commandError); ok {
+				replyError(client, packet, commandErr.status, commandErr.text)
+				continue
+			} else if err != nil {
 				log.Println(err.Error())
-				sendPacket(client, 404, nil)
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
 			}
-			serial := createSerializer()
-			serial.String(username, 1)
-			sendPacket(client, 200, serial.buffer.Bytes())
-		case 8:
-			parser := parserStruct{buffer, dataLen, 0}
-			idCount, err := parser.UInt16()
+			response := protocol.GroupCommandResponse{Text: strings.Join(ctx.replies, "\n")}
+			data, err := response.Marshal()
 			if err != nil {
+				client.Reply(packet, protocol.StatusServerError, nil)
 				continue
 			}
-			ids := make([]uint64, idCount)
-			var i uint16
-			for i = 0; i < idCount; i++ {
-				ids[i], err = parser.UInt64()
-				if err != nil {
-					continue
-				}
+			client.Reply(packet, protocol.StatusOK, data)
+
+		case protocol.OpAcceptInvite, protocol.OpDeclineInvite:
+			var request protocol.InviteRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
 			}
-			serial := createSerializer()
-			serial.UInt16(idCount)
-			for i = 0; i < idCount; i++ {
-				serial.UInt64(ids[i])
-				if err != nil {
-					continue
-				}
-				if isOnline(ids[i]) {
-					serial.Byte(1)
-				} else {
-					serial.Byte(0)
-				}
+			invite, err := pendingInvite(clID, request.InviteID)
+			if err != nil {
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			}
+			if packet.OpCode == protocol.OpDeclineInvite {
+				appDB.Delete(invite)
+				client.Reply(packet, protocol.StatusOK, nil)
+				continue
+			}
+			err = acceptInvite(clID, invite)
+			if err == errNoInvite {
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			} else if err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
 			}
+			response := protocol.JoinResponse{GroupID: invite.GroupID}
+			data, _ := response.Marshal()
+			client.Reply(packet, protocol.StatusOK, data)
+
+		case protocol.OpSearchGroups:
+			var request protocol.SearchGroupsRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			groups, err := searchGroups(request.Query)
+			if err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
+			}
+			response := protocol.SearchGroupsResponse{Groups: groups}
+			data, err := response.Marshal()
+			if err != nil {
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
+			}
+			client.Reply(packet, protocol.StatusOK, data)
 
-			sendPacketToSubscriber(clID, 8, serial.buffer.Bytes())
+		case protocol.OpJoinGroup:
+			var request protocol.JoinGroupRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			var group groupStruct
+			appDB.First(&group, "id = ?", request.GroupID)
+			if group.ID == 0 {
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			} else if isGroupMember(clID, group.ID) {
+				client.Reply(packet, protocol.StatusConflict, nil)
+				continue
+			} else if !group.Public {
+				replyError(client, packet, protocol.StatusForbidden, "The group is private")
+				continue
+			}
+			if err := joinGroup(clID, group.ID); err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
+			}
+			response := protocol.JoinResponse{GroupID: group.ID}
+			data, _ := response.Marshal()
+			client.Reply(packet, protocol.StatusOK, data)
+
+		case protocol.OpPing:
+			client.Reply(packet, protocol.OpPong, nil)
+
+		case protocol.OpPong:
+
+		case protocol.OpAck:
+			var request protocol.AckRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				continue
+			}
+			if request.State != protocol.ReceiptDelivered && request.State != protocol.ReceiptRead {
+				continue
+			}
+			for _, messageID := range request.MessageIDs {
+				updateReceipt(messageID, clID, request.State)
+			}
+
+		case protocol.OpLogout:
+			var request protocol.LogoutRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			revokeToken(clID, request.Token)
+			client.Reply(packet, protocol.StatusOK, nil)
+			fmt.Println("Logout of", clID)
+			client.Close() // The failed read cleans the session up
+
+		case protocol.OpChangePassword:
+			var request protocol.ChangePasswordRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			var user userStruct
+			appDB.First(&user, "id = ?", clID)
+			if user.ID == 0 {
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			}
+			if !confirmPassword(client, packet, &user, request.OldPassword) {
+				continue
+			}
+			if reason := validatePassword(user.Username, request.NewPassword); reason != "" {
+				replyError(client, packet, protocol.StatusNotAcceptable, reason)
+				continue
+			}
+			token, err := changePassword(&user, request.NewPassword)
+			if err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
+			}
+			fmt.Println("Password changed for", user.Username)
+			replyAuth(client, packet, user.ID, token)
+			registry.closeOthers(clID, client, token)
+
+		case protocol.OpDeleteAccount:
+			var request protocol.DeleteAccountRequest
+			if err := request.Unmarshal(packet.Data); err != nil {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			var user userStruct
+			appDB.First(&user, "id = ?", clID)
+			if user.ID == 0 {
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			}
+			if !confirmPassword(client, packet, &user, request.Password) {
+				continue
+			}
+			err := deleteAccount(&user)
+			if err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
+			}
+			fmt.Println("Account deleted", user.Username)
+			client.Reply(packet, protocol.StatusOK, nil)
+			registry.closeAll(clID) // The failed reads clean the sessions up
+
+		case protocol.OpHistory:
+			var request protocol.HistoryRequest
+			if err := request.Unmarshal(packet.Data); err != nil || (request.UserID == 0) == (request.GroupID == 0) {
+				client.Reply(packet, protocol.StatusBadRequest, nil)
+				continue
+			}
+			if request.GroupID != 0 && !isGroupMember(clID, request.GroupID) {
+				client.Reply(packet, protocol.StatusNotFound, nil)
+				continue
+			}
+			history, err := getHistory(clID, &request)
+			if err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
+			}
+			response := protocol.HistoryResponse{Messages: history}
+			data, err := response.Marshal()
+			if err != nil {
+				client.Reply(packet, protocol.StatusServerError, nil)
+				continue
+			}
+			client.Reply(packet, protocol.StatusOK, data)
 
 		default:
 		}
@@ -391,369 +568,565 @@ func handlePacket(clID uint64, client net.Conn) {
 	//handleNextPacket(client)
 }
 
-func handleSession(client net.Conn) {
-	fmt.Println("Session started for " + client.RemoteAddr().String())
+func handleSession(connection net.Conn) {
+	fmt.Println("Session started for " + connection.RemoteAddr().String())
+
+	client := protocol.NewConn(connection)
+	client.MaxFrameSize = PREAUTHFRAMESIZE
+	client.MaxMessageSize = PREAUTHFRAMESIZE // Credentials always fit into a single frame
 
 	var (
-		err      error
-		opCode   uint16
-		buffer   []byte
-		nLen     byte
-		username string
-		passLen  byte
-		password []byte
-		hash     [32]byte
-		id       uint64
+		id        uint64
+		username  string
+		multiplex bool
+		device    *session
 	)
+	ip := remoteIP(connection.RemoteAddr())
 
 	for {
-		err, _, opCode, buffer = readPacket(client, 0)
+		packet, err := client.ReadPacket(protocol.IdleTimeout)
 		if err != nil {
 			log.Println(err.Error())
-			return
-		}
-
-		parser := parserStruct{buffer, uint16(len(buffer)), 0}
-
-		if !(opCode == 4 || opCode == 5 || opCode == 10) {
-			fmt.Println("Session error, unauthorized")
-			sendPacket(client, 401, nil)
 			client.Close()
 			return
 		}
-		nLen, err = parser.Byte()
-		if err != nil {
-			return
+
+		opCode := packet.OpCode
+		if opCode == protocol.OpPing {
+			// The client pings while the user is on the sign in window
+			client.Reply(packet, protocol.OpPong, nil)
+			continue
 		}
-		if nLen == 0 {
-			fmt.Println("Session error, bad request")
-			sendPacket(client, 400, nil)
+		if !(opCode == protocol.OpRegister || opCode == protocol.OpAuth || opCode == protocol.OpSubscribe) {
+			fmt.Println("Session error, unauthorized")
+			client.Reply(packet, protocol.StatusUnauthorized, nil)
 			client.Close()
 			return
 		}
-		username, err = parser.String(uint16(nLen))
+		var credentials protocol.Credentials
+		err = credentials.Unmarshal(packet.Data)
 		if err != nil {
 			fmt.Println("Session error, bad request")
-			sendPacket(client, 400, nil)
+			client.Reply(packet, protocol.StatusBadRequest, nil)
 			return
 		}
-		passLen, err = parser.Byte()
-		if err != nil {
+		if credentials.Username == "" || credentials.Password == "" {
 			fmt.Println("Session error, bad request")
-			sendPacket(client, 400, nil)
+			client.Reply(packet, protocol.StatusBadRequest, nil)
+			client.Close()
 			return
 		}
-		if passLen == 0 {
-			fmt.Println("Session error, bad request")
-			sendPacket(client, 400, nil)
+		if opCode == protocol.OpRegister && credentials.Options&protocol.OptionToken != 0 {
+			fmt.Println("Session error, register with a token")
+			client.Reply(packet, protocol.StatusBadRequest, nil)
 			client.Close()
 			return
 		}
-		password, err = parser.Chunk(uint16(passLen))
-		if err != nil {
-			fmt.Println("Session error, bad request")
-			sendPacket(client, 400, nil)
-			return
+		username = credentials.Username
+		multiplex = opCode != protocol.OpSubscribe && credentials.Options&protocol.OptionMultiplex != 0
+
+		if opCode != protocol.OpRegister {
+			if wait := loginWait(username, ip); wait > 0 {
+				replyRetryAfter(client, packet, wait)
+				fmt.Println("Rate limited auth from", username, ip)
+				continue
+			}
 		}
 
-		hash = sha256.Sum256(password)
-		if opCode == 5 {
+		if opCode == protocol.OpAuth {
 			var user userStruct
 			appDB.First(&user, "username = ?", username)
-			if isOnline(uint64(user.ID)) {
-				sendPacket(client, 409, nil)
-				return
-			} else if reflect.DeepEqual(user, userStruct{}) {
-				sendPacket(client, 404, nil)
+			if reflect.DeepEqual(user, userStruct{}) {
+				loginFailed("", ip)
+				client.Reply(packet, protocol.StatusNotFound, nil)
 				fmt.Println("Received NX auth from", username)
-			} else if bytes.Equal(hash[:], user.Hash[:]) {
-				users[uint64(user.ID)] = client
-				sendPacket(client, 200, nil)
+			} else if checkCredentials(&user, &credentials) {
+				loginSucceeded(username, ip)
+				token := credentials.Password // Resumed session keeps its token
+				if credentials.Options&protocol.OptionToken == 0 {
+					upgradePassword(&user, credentials.Password)
+					token, err = issueToken(appDB, user.ID)
+					if err != nil {
+						log.Println(err.Error())
+						client.Reply(packet, protocol.StatusServerError, nil)
+						client.Close()
+						return
+					}
+				}
+				device = registry.add(user.ID, token, client)
+				replyAuth(client, packet, user.ID, token)
 				fmt.Println("Received auth from", username)
 				id = uint64(user.ID)
 				break
 			} else {
-				sendPacket(client, 423, nil)
+				loginFailed(username, ip)
+				client.Reply(packet, credentialsError(&credentials), nil)
 				fmt.Println("Received wrong password from", username)
 			}
-		} else if opCode == 4 {
-			var user userStruct
-			appDB.First(&user, "username = ?", username)
-			if isOnline(uint64(user.ID)) {
-				sendPacket(client, 409, nil)
-				return
-			} else if reflect.DeepEqual(user, userStruct{}) {
-				fmt.Println("Received register from", username)
-				appDB.Create(&userStruct{Username: username, Hash: hash[:]})
-				sendPacket(client, 200, nil)
-				users[uint64(user.ID)] = client
-				id = uint64(user.ID)
-				break
-			} else {
-				sendPacket(client, 406, nil)
+		} else if opCode == protocol.OpRegister {
+			if reason := validateRegistration(username, credentials.Password); reason != "" {
+				replyError(client, packet, protocol.StatusNotAcceptable, reason)
+				fmt.Println("Rejected register from", username+":", reason)
+				continue
+			}
+			user, token, err := registerUser(username, credentials.Password)
+			if err == errUserExists {
+				replyError(client, packet, protocol.StatusNotAcceptable, err.Error())
 				fmt.Println("User already exists", username)
+				continue
+			} else if err != nil {
+				log.Println(err.Error())
+				client.Reply(packet, protocol.StatusServerError, nil)
+				client.Close()
+				return
 			}
-		} else if opCode == 10 {
+			fmt.Println("Received register from", username)
+			device = registry.add(user.ID, token, client)
+			replyAuth(client, packet, user.ID, token)
+			id = user.ID
+			break
+		} else if opCode == protocol.OpSubscribe {
 			var user userStruct
 			appDB.First(&user, "username = ?", username)
-			if isOnline(uint64(user.ID)) {
-				sendPacket(client, 409, nil)
-				return
-			} else if reflect.DeepEqual(user, userStruct{}) {
-				sendPacket(client, 404, nil)
+			if reflect.DeepEqual(user, userStruct{}) {
+				loginFailed("", ip)
+				client.Reply(packet, protocol.StatusNotFound, nil)
 				fmt.Println("Received NX auth from", username)
-			} else if bytes.Equal(hash[:], user.Hash[:]) {
-				sendPacket(client, 200, nil)
+			} else if checkCredentials(&user, &credentials) {
+				loginSucceeded(username, ip)
+				client.Reply(packet, protocol.StatusOK, nil)
 				id = uint64(user.ID)
-				subscription[id] = client
+				token := ""
+				if credentials.Options&protocol.OptionToken != 0 {
+					token = credentials.Password
+				}
+				if registry.subscribe(id, token, client) {
+					go presenceChanged(id)
+				}
 				fmt.Println("Received subscribe from", username)
-				go sendHelloFromGroup(id, 0)
+				go flushQueue(id)
+				go sendHelloFromGroup(id, 0, client)
+				go sendPresenceSnapshot(id, client)
+				go sendPendingInvites(id, client)
 				break
 			} else {
-				sendPacket(client, 423, nil)
+				loginFailed(username, ip)
+				client.Reply(packet, credentialsError(&credentials), nil)
 				fmt.Println("Received wrong password from", username)
 			}
 		}
 	}
 
+	if multiplex {
+		// Events are pushed to this connection, no subscription connection follows
+		if registry.multiplex(device) {
+			go presenceChanged(id)
+		}
+		fmt.Println("Multiplexed session for", username)
+		go flushQueue(id)
+		go sendHelloFromGroup(id, 0, client)
+		go sendPresenceSnapshot(id, client)
+		go sendPendingInvites(id, client)
+	}
+
+	client.MaxFrameSize = MAXFRAMESIZE
+	client.MaxMessageSize = MAXMESSAGESIZE
 	handlePacket(id, client)
 }
 
-func listenClient(IP string, PORT string) int {
-	socket, error := net.Listen("tcp", fmt.Sprintf("%s:%s", ADDRESS, PORT))
-	if error != nil {
-		fmt.Println("Error while server startup: " + error.Error())
-		return 1
+//
+// Passwords
+//
+
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), PASSWORDCOST)
+}
+
+func checkPassword(user *userStruct, password string) bool {
+	switch user.Scheme {
+	case hashBcrypt:
+		return bcrypt.CompareHashAndPassword(user.Hash, []byte(password)) == nil
+	case hashSHA256:
+		hash := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(hash[:], user.Hash) == 1
 	}
-	fmt.Printf("Chat server started at %s:%s\n", ADDRESS, PORT)
-	for {
-		connection, error := socket.Accept()
-		if error != nil {
-			fmt.Println("Error in connection establishment:\n" + error.Error())
-			connection.Close()
-			continue
+	return false
+}
+
+// upgradePassword rehashes a checked password if it is stored with the legacy
+// scheme or a lower cost
+func upgradePassword(user *userStruct, password string) {
+	if user.Scheme == hashBcrypt {
+		cost, err := bcrypt.Cost(user.Hash)
+		if err == nil && cost >= PASSWORDCOST {
+			return
 		}
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	appDB.Model(user).Updates(map[string]interface{}{"hash": hash, "scheme": hashBcrypt})
+	fmt.Println("Upgraded password hash of", user.Username)
+}
 
-		go handleSession(connection)
+// confirmPassword checks the password of a signed in user before a change of
+// the account. The attempts count for the rate limit of the logins, the
+// failures are answered.
+func confirmPassword(client *protocol.Conn, packet *protocol.Packet, user *userStruct, password string) bool {
+	ip := remoteIP(client.RemoteAddr())
+	if wait := loginWait(user.Username, ip); wait > 0 {
+		replyRetryAfter(client, packet, wait)
+		fmt.Println("Rate limited password check of", user.Username, ip)
+		return false
+	}
+	if !checkPassword(user, password) {
+		loginFailed(user.Username, ip)
+		client.Reply(packet, protocol.StatusLocked, nil)
+		return false
 	}
+	loginSucceeded(user.Username, ip)
+	return true
+}
+
+func remoteIP(addr net.Addr) string {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return ip
+}
+
+// checkCredentials checks the password or, with OptionToken, the session token
+func checkCredentials(user *userStruct, credentials *protocol.Credentials) bool {
+	if credentials.Options&protocol.OptionToken != 0 {
+		return checkToken(credentials.Password) == user.ID
+	}
+	return checkPassword(user, credentials.Password)
+}
+
+// credentialsError is the response to wrong credentials: 401 tells the client
+// to forget its session token and ask for the password
+func credentialsError(credentials *protocol.Credentials) protocol.OpCode {
+	if credentials.Options&protocol.OptionToken != 0 {
+		return protocol.StatusUnauthorized
+	}
+	return protocol.StatusLocked
 }
 
 //
-// Packet reading
+// Session tokens
 //
 
-func readPacket(client net.Conn, timeout int64) (out_err error, dataLen uint16, opCode uint16, buffer []byte) {
-	//defer readRecover(client, &exitCode)
-	if timeout != 0 {
-		client.SetReadDeadline(time.Now().Add(time.Duration(timeout * int64(time.Second))))
-	} else {
-		client.SetReadDeadline(time.Time{})
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func issueToken(db *gorm.DB, userID uint64) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
 	}
-	dataLenB := make([]byte, 2)
-	_, err := client.Read(dataLenB)
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err := db.Create(&tokenStruct{UserID: userID, Hash: hashToken(token), ExpiresAt: time.Now().Add(TOKENLIFETIME)}).Error
 	if err != nil {
-		fmt.Println("Error in message receiving(len): " + err.Error())
-		client.Close()
-		out_err = err
-		return
+		return "", err
 	}
-	dataLen = binary.LittleEndian.Uint16(dataLenB)
-	opCodeB := make([]byte, 2)
-	_, err = client.Read(opCodeB)
-	if err != nil {
-		fmt.Println("Error in message receiving(opCode): " + err.Error())
-		client.Close()
-		out_err = err
-		return
+	return token, nil
+}
+
+// checkToken returns the user of a valid token, 0 if it is unknown or expired
+func checkToken(token string) uint64 {
+	var stored tokenStruct
+	appDB.First(&stored, "hash = ?", hashToken(token))
+	if stored.ID == 0 {
+		return 0
 	}
-	opCode = binary.LittleEndian.Uint16(opCodeB)
-	if dataLen != 0 {
-		buffer = make([]byte, dataLen)
-		_, err = client.Read(buffer)
-		if err != nil {
-			fmt.Println("Error in message receiving(data): " + err.Error())
-			client.Close()
-			out_err = err
-			return
+	if time.Now().After(stored.ExpiresAt) {
+		appDB.Delete(&stored)
+		return 0
+	}
+	return stored.UserID
+}
+
+func revokeToken(userID uint64, token string) {
+	appDB.Delete(tokenStruct{}, "user_id = ? AND hash = ?", userID, hashToken(token))
+}
+
+func replyAuth(client *protocol.Conn, packet *protocol.Packet, userID uint64, token string) {
+	response := protocol.AuthResponse{UserID: userID, Token: token}
+	data, _ := response.Marshal()
+	client.Reply(packet, protocol.StatusOK, data)
+}
+
+func replyRetryAfter(client *protocol.Conn, packet *protocol.Packet, wait time.Duration) {
+	seconds := uint32((wait + time.Second - 1) / time.Second)
+	response := protocol.RetryResponse{Seconds: seconds}
+	data, _ := response.Marshal()
+	client.Reply(packet, protocol.StatusTooManyRequests, data)
+}
+
+func replyError(client *protocol.Conn, packet *protocol.Packet, status protocol.OpCode, reason string) {
+	// Reasons quoting the arguments of a command may not fit into 255 bytes
+	if len(reason) > 255 {
+		reason = reason[:255]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1] // Cut in the middle of a character
 		}
-	} else {
-		buffer = nil
-		return
 	}
-	return
+	response := protocol.ErrorResponse{Reason: reason}
+	data, _ := response.Marshal()
+	client.Reply(packet, status, data)
 }
 
-func readPacketFromSubscriber(id uint64, timeout int64) (out_err error, dataLen uint16, opCode uint16, buffer []byte) {
-	defer recover()
-	client, ok := subscription[id]
-	if !ok {
-		return errors.New("No subscription available"), 0, 0, nil
+//
+// Registration
+//
+
+// validateRegistration returns why the username or the password can't be
+// used for a new account, "" if they can
+func validateRegistration(username, password string) string {
+	if reason := validateUsername(username); reason != "" {
+		return reason
 	}
-	if client == nil {
-		return errors.New("No subscription available"), 0, 0, nil
+	return validatePassword(username, password)
+}
+
+func validateUsername(username string) string {
+	if len(username) < USERNAMEMINLEN || len(username) > USERNAMEMAXLEN {
+		return fmt.Sprintf("Username must have %d to %d characters", USERNAMEMINLEN, USERNAMEMAXLEN)
 	}
-	if timeout != 0 {
-		client.SetReadDeadline(time.Now().Add(time.Duration(timeout * int64(time.Second))))
-	} else {
-		client.SetReadDeadline(time.Time{})
+	for _, c := range username {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return "Username may contain only latin letters, digits, \"_\", \"-\" and \".\""
+		}
 	}
-	dataLenB := make([]byte, 2)
-	_, err := client.Read(dataLenB)
-	if err != nil {
-		fmt.Println("Error in message receiving(len): " + err.Error())
-		client.Close()
-		out_err = err
-		return
+	return ""
+}
+
+func validatePassword(username, password string) string {
+	if len(password) < PASSWORDMINLEN || len(password) > PASSWORDMAXLEN {
+		return fmt.Sprintf("Password must have %d to %d bytes", PASSWORDMINLEN, PASSWORDMAXLEN)
 	}
-	dataLen = binary.LittleEndian.Uint16(dataLenB)
-	opCodeB := make([]byte, 2)
-	_, err = client.Read(opCodeB)
+	if strings.EqualFold(password, username) {
+		return "Password must differ from the username"
+	}
+	return ""
+}
+
+// registerUser creates the account and its first session token in one
+// transaction. The unique index on the username rejects duplicates.
+func registerUser(username, password string) (userStruct, string, error) {
+	hash, err := hashPassword(password)
 	if err != nil {
-		fmt.Println("Error in message receiving(opCode): " + err.Error())
-		client.Close()
-		out_err = err
-		return
+		return userStruct{}, "", err
 	}
-	opCode = binary.LittleEndian.Uint16(opCodeB)
-	if dataLen != 0 {
-		buffer = make([]byte, dataLen)
-		_, err = client.Read(buffer)
-		if err != nil {
-			fmt.Println("Error in message receiving(data): " + err.Error())
-			client.Close()
-			out_err = err
-			return
+	user := userStruct{Username: username, Hash: hash, Scheme: hashBcrypt}
+	tx := appDB.Begin()
+	err = tx.Create(&user).Error
+	if err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return userStruct{}, "", errUserExists
 		}
-	} else {
-		buffer = nil
-		return
+		return userStruct{}, "", err
+	}
+	token, err := issueToken(tx, user.ID)
+	if err != nil {
+		tx.Rollback()
+		return userStruct{}, "", err
 	}
-	return
+	return user, token, tx.Commit().Error
 }
 
-func sendPacket(client net.Conn, opCode uint16, data []byte) error {
-	var buffer bytes.Buffer
-	opCodeB := make([]byte, 2)
-	if data != nil {
-		lenB := make([]byte, 2)
-		length := len(data)
-		if len(data) > 65535 {
-			return errors.New("Data is to big, packet split is not implemented")
-		}
-		binary.LittleEndian.PutUint16(lenB, uint16(length))
-		binary.LittleEndian.PutUint16(opCodeB, opCode)
+//
+// Account management
+//
 
-		buffer.Write(lenB)
-		buffer.Write(opCodeB)
-		buffer.Write(data)
-		_, err := client.Write(buffer.Bytes())
-		if err != nil {
-			fmt.Println("Error in message sending: " + err.Error())
-			return err
-		}
-		return nil
-	} else {
-		lenB := []byte{0, 0}
-		binary.LittleEndian.PutUint16(opCodeB, opCode)
+// changePassword stores the new password, revokes the session tokens of the
+// user and returns a new one for the current session
+func changePassword(user *userStruct, password string) (string, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	tx := appDB.Begin()
+	err = tx.Model(user).Updates(map[string]interface{}{"hash": hash, "scheme": hashBcrypt}).Error
+	if err == nil {
+		err = tx.Delete(tokenStruct{}, "user_id = ?", user.ID).Error
+	}
+	var token string
+	if err == nil {
+		token, err = issueToken(tx, user.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return token, tx.Commit().Error
+}
 
-		buffer.Write(lenB)
-		buffer.Write(opCodeB)
-		_, err := client.Write(buffer.Bytes())
-		if err != nil {
-			fmt.Println("Error in message sending: " + err.Error())
-			return err
+// deleteAccount removes the user with its memberships, sessions and pending
+// receipts. Owned groups pass to the remaining member with the highest role,
+// the one who joined first among equals. Groups without other members are
+// deleted. The stored messages stay in the history of the other users.
+func deleteAccount(user *userStruct) error {
+	var memberships []groupMemberStruct
+	appDB.Find(&memberships, "user_id = ?", user.ID)
+
+	var announcements []msgStruct
+	tx := appDB.Begin()
+	fail := func(err error) error {
+		tx.Rollback()
+		return err
+	}
+	for _, membership := range memberships {
+		var group groupStruct
+		if err := tx.First(&group, "id = ?", membership.GroupID).Error; err != nil {
+			return fail(err)
 		}
-		return nil
+		var heir groupMemberStruct
+		err := tx.Order("role desc, id").First(&heir, "group_id = ? AND user_id <> ?", membership.GroupID, user.ID).Error
+		if gorm.IsRecordNotFoundError(err) {
+			if err := deleteGroupRecords(tx, membership.GroupID); err != nil {
+				return fail(err)
+			}
+			continue
+		} else if err != nil {
+			return fail(err)
+		}
+		announcements = append(announcements, msgStruct{nil, user.Username + " deleted the account", true, membership.GroupID, 1, 0})
+		if group.OwnerID == user.ID {
+			if err := tx.Model(&group).Update("owner_id", heir.UserID).Error; err != nil {
+				return fail(err)
+			}
+			if err := tx.Model(&heir).Update("role", roleOwner).Error; err != nil {
+				return fail(err)
+			}
+			announcements = append(announcements, msgStruct{nil, heir.Username + " is now owner of the group", true, membership.GroupID, 1, 0})
+		}
+	}
+	if err := tx.Delete(groupMemberStruct{}, "user_id = ?", user.ID).Error; err != nil {
+		return fail(err)
+	}
+	if err := tx.Delete(inviteStruct{}, "user_id = ? OR inviter_id = ?", user.ID, user.ID).Error; err != nil {
+		return fail(err)
+	}
+	if err := tx.Delete(tokenStruct{}, "user_id = ?", user.ID).Error; err != nil {
+		return fail(err)
+	}
+	if err := tx.Delete(receiptStruct{}, "user_id = ?", user.ID).Error; err != nil {
+		return fail(err)
+	}
+	if err := tx.Delete(userStruct{}, "id = ?", user.ID).Error; err != nil {
+		return fail(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	for i := range announcements {
+		go sendMessage(&announcements[i])
 	}
+	return nil
+}
+
+func listenClient(IP string, PORT string) int {
+	socket, error := net.Listen("tcp", fmt.Sprintf("%s:%s", ADDRESS, PORT))
+	if error != nil {
+		fmt.Println("Error while server startup: " + error.Error())
+		return 1
+	}
+	fmt.Printf("Chat server started at %s:%s\n", ADDRESS, PORT)
+	return acceptClients(socket)
+}
+
+func listenClientTLS(IP string, PORT string, config *tls.Config) int {
+	socket, error := tls.Listen("tcp", fmt.Sprintf("%s:%s", IP, PORT), config)
+	if error != nil {
+		fmt.Println("Error while TLS server startup: " + error.Error())
+		return 1
+	}
+	fmt.Printf("TLS chat server started at %s:%s\n", IP, PORT)
+	return acceptClients(socket)
 }
-func sendPacketToSubscriber(id uint64, opCode uint16, data []byte) error {
-	client, ok := subscription[id]
-	if !ok || client == nil {
-		return errors.New("No subscription available")
-	}
-	var buffer bytes.Buffer
-	opCodeB := make([]byte, 2)
-	if data != nil {
-		lenB := make([]byte, 2)
-		length := len(data)
-		if len(data) > 65535 {
-			return errors.New("Data is to big, packet split is not implemented")
+
+func acceptClients(socket net.Listener) int {
+	for {
+		connection, error := socket.Accept()
+		if error != nil {
+			fmt.Println("Error in connection establishment:\n" + error.Error())
+			connection.Close()
+			continue
 		}
-		binary.LittleEndian.PutUint16(lenB, uint16(length))
-		binary.LittleEndian.PutUint16(opCodeB, opCode)
 
-		buffer.Write(lenB)
-		buffer.Write(opCodeB)
-		buffer.Write(data)
-		_, err := client.Write(buffer.Bytes())
-		if err != nil {
-			fmt.Println("Error in message sending: " + err.Error())
-			return err
+		go handleSession(connection)
+	}
+}
+
+//
+// Packet sending
+//
+
+// heartbeat pings the client every protocol.PingInterval until done is closed
+func heartbeat(client *protocol.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(protocol.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			client.SendPacket(protocol.OpPing, nil)
+		case <-done:
+			return
 		}
-		return nil
-	} else {
-		lenB := []byte{0, 0}
-		binary.LittleEndian.PutUint16(opCodeB, opCode)
+	}
+}
 
-		buffer.Write(lenB)
-		buffer.Write(opCodeB)
-		_, err := client.Write(buffer.Bytes())
-		if err != nil {
-			fmt.Println("Error in message sending: " + err.Error())
-			return err
+func sendPacketToSubscriber(id uint64, opCode protocol.OpCode, data []byte) error {
+	return sendPacketToSessions(id, nil, nil, opCode, data)
+}
+
+// sendPacketToSessions queues an event for the subscribed devices of the user:
+// only to the session of the connection only if it is not nil, and not to the
+// session of the connection except. Returns an error if no device took it.
+func sendPacketToSessions(id uint64, only, except *protocol.Conn, opCode protocol.OpCode, data []byte) error {
+	err := errors.New("No subscription available")
+	for _, device := range registry.subscribed(id, only, except) {
+		if sendErr := device.outbox.send(opCode, data); sendErr != nil {
+			fmt.Println("Error in message sending: " + sendErr.Error())
+			continue
 		}
-		return nil
+		err = nil
 	}
+	return err
 }
 
 func addUserToGroup() {
 
 }
 
-//0 - all groups
-func sendHelloFromGroup(id uint64, currentGroup uint64) {
+//0 - all groups. The hello goes only to the session of events if not nil.
+func sendHelloFromGroup(id uint64, currentGroup uint64, events *protocol.Conn) {
 	if currentGroup == 0 {
-		var groupID uint64
-		var iterId uint64
-		var iterUsername string
-		rows, err := appDB.Raw("SELECT group_id FROM group_member_structs WHERE user_id = " + strconv.FormatUint(id, 10)).Rows()
-
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
-		for rows.Next() {
-			err = rows.Scan(&groupID)
-			if err != nil {
-				fmt.Print(err.Error())
-			}
-			counter := 1
-			list := "Admin commands: /add /kick /grant\nCommon commands: /leave /list\nList of users in group"
-			rows1, err := appDB.Raw("SELECT user_id, username FROM group_member_structs WHERE group_id = " + strconv.FormatUint(groupID, 10)).Rows()
-
+		var groups []groupStruct
+		appDB.Where("id IN (SELECT group_id FROM group_member_structs WHERE user_id = ?)", id).Find(&groups)
+		for i := range groups {
+			list, err := memberList(&groups[i])
 			if err != nil {
 				fmt.Println(err.Error())
 				return
 			}
-			for rows1.Next() {
-				err = rows1.Scan(&iterId, &iterUsername)
-				list += "\n"
-				list += strconv.Itoa(counter) + ". "
-				if isOnline(iterId) {
-					list += " 🔵 "
-				} else {
-					list += " 🌑 "
-				}
-				list += iterUsername
-				counter++
-			}
-
-			go sendSystemMessageToUserInGroup(&msgStruct{nil, list, true, groupID, 1}, id)
+			text := helpText(roleOf(id, &groups[i])) + "\nList of users in group" + list
+			sendGroupInfo(id, &groups[i], events)
+			go sendSystemMessageToUserInGroup(&msgStruct{events, text, true, groups[i].ID, 1, 0}, id)
 		}
 	} else {
-		list := "Admin commands: /add /kick /grant\nCommon commands: /leave /list"
-
-		go sendSystemMessageToUserInGroup(&msgStruct{nil, list, true, currentGroup, 1}, id)
+		var group groupStruct
+		appDB.First(&group, "id = ?", currentGroup)
+		sendGroupInfo(id, &group, events)
+		go sendSystemMessageToUserInGroup(&msgStruct{events, helpText(roleOf(id, &group)), true, currentGroup, 1, 0}, id)
 	}
 }
 
@@ -763,14 +1136,14 @@ func sendHelloFromGroup(id uint64, currentGroup uint64) {
 //
 //
 
-func createGroup(clID uint64, buffer []byte, dataLen uint16) (uint64, error) { //returns groupID
-	parser := parserStruct{buffer, dataLen, 0}
-	nLen, err := parser.Byte()
+func createGroup(clID uint64, data []byte) (uint64, error) { //returns groupID
+	var request protocol.CreateGroupRequest
+	err := request.Unmarshal(data)
 	if err != nil {
 		return 0, errors.New("400")
 	}
-	groupName, err := parser.String(uint16(nLen))
-	if err != nil {
+	groupName := normalizeGroupName(request.Name)
+	if groupName == "" {
 		return 0, errors.New("400")
 	}
 	var group groupStruct
@@ -780,10 +1153,10 @@ func createGroup(clID uint64, buffer []byte, dataLen uint16) (uint64, error) { /
 		return 0, errors.New("500")
 	}
 	if reflect.DeepEqual(group, groupStruct{}) {
-		appDB.Create(&groupStruct{OwnerID: clID, Verbose: groupName})
+		appDB.Create(&groupStruct{OwnerID: clID, Verbose: groupName, Public: request.Public})
 		appDB.First(&group, "verbose = ?", groupName)
-		appDB.Create(&groupMemberStruct{UserID: clID, GroupID: group.ID, Username: username})
-		sendHelloFromGroup(clID, group.ID)
+		appDB.Create(&groupMemberStruct{UserID: clID, GroupID: group.ID, Username: username, Role: roleOwner})
+		sendHelloFromGroup(clID, group.ID, nil)
 		return uint64(group.ID), nil
 	} else {
 		return 0, errors.New("409")
@@ -819,35 +1192,22 @@ func getNamebyUserID(id uint64) (string, error) {
 	}
 }
 
-func sendMessage(msg *msgStruct) {
-	serial := createSerializer()
-	serial.UInt64(msg.sender)
+// sendMessage pushes the message to its recipients. Returns true if the
+// message was queued for a recipient who is offline.
+func sendMessage(msg *msgStruct) bool {
+	if msg.sender == 1 && msg.messageID == 0 {
+		// Announcements of group changes are stored like the messages of the users
+		msg.messageID = storeMessage(1, 0, msg.ID, msg.message)
+	}
+	timestamp := protocol.Timestamp(messageTime(msg.messageID))
 	if msg.group == false {
-		serial.UInt64(msg.ID)
-		serial.UInt64(0)
-		serial.String(msg.message, 2)
-		err := sendPacketToSubscriber(msg.ID, 1, serial.buffer.Bytes())
-
-		err, _, opCode, _ := readPacketFromSubscriber(msg.ID, 0)
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
-
-		switch opCode {
-		case 200:
-			return
-		case 400:
-			fmt.Println("Bad syntax???")
-			return
-		case 404:
-			fmt.Println("Wrong receipient")
-			return
-		default:
-			fmt.Println("Unknown response")
-			return
+		push := protocol.Message{SenderID: msg.sender, UserID: msg.ID, Text: msg.message, MessageID: msg.messageID, Timestamp: timestamp}
+		err := pushMessage(msg.ID, &push)
+		if msg.sender != msg.ID {
+			// The other devices of the sender see the message too
+			pushMessageToSessions(msg.sender, nil, msg.client, &push)
 		}
-
+		return addReceipt(msg.messageID, msg.ID, err != nil)
 	} else {
 		var userID uint64
 		rows, err := appDB.Raw("SELECT user_id FROM group_member_structs WHERE group_id = " + strconv.FormatUint(msg.ID, 10)).Rows()
@@ -855,7 +1215,7 @@ func sendMessage(msg *msgStruct) {
 		var usersToSend []uint64
 		if err != nil {
 			fmt.Println(err.Error())
-			return
+			return false
 		}
 		for rows.Next() {
 			err = rows.Scan(&userID)
@@ -877,245 +1237,213 @@ func sendMessage(msg *msgStruct) {
 		}
 
 		if notInGroup {
-			serial := createSerializer()
-			serial.UInt64(1)
-			serial.UInt64(0)
-			serial.UInt64(msg.ID)
-			serial.String("You are not the member of the group", 2)
-
-			sendPacketToSubscriber(msg.sender, 1, serial.buffer.Bytes())
-			return
+			pushMessage(msg.sender, &protocol.Message{SenderID: 1, GroupID: msg.ID, Text: "You are not the member of the group"})
+			return false
 		}
 
+		queued := false
 		for i := range usersToSend {
-			serial := createSerializer()
-			serial.UInt64(msg.sender)
-			serial.UInt64(0)
-			serial.UInt64(msg.ID)
-			serial.String(msg.message, 2)
-
-			sendPacketToSubscriber(usersToSend[i], 1, serial.buffer.Bytes())
+			push := protocol.Message{SenderID: msg.sender, GroupID: msg.ID, Text: msg.message, MessageID: msg.messageID, Timestamp: timestamp}
+			if usersToSend[i] == msg.sender {
+				pushMessageToSessions(msg.sender, nil, msg.client, &push)
+				continue
+			}
+			err := pushMessage(usersToSend[i], &push)
+			if addReceipt(msg.messageID, usersToSend[i], err != nil) {
+				queued = true
+			}
 		}
-		return
+		return queued
 	}
 }
 
+// sendSystemMessageToUserInGroup pushes to the session of msg.client only if set
 func sendSystemMessageToUserInGroup(msg *msgStruct, userID uint64) {
-	serial := createSerializer()
-	serial.UInt64(msg.sender)
-	serial.UInt64(0)
-	serial.UInt64(msg.ID)
-	serial.String(msg.message, 2)
+	pushMessageToSessions(userID, msg.client, nil, &protocol.Message{SenderID: msg.sender, GroupID: msg.ID, Text: msg.message})
+}
 
-	err := sendPacketToSubscriber(userID, 1, serial.buffer.Bytes())
+func pushMessage(userID uint64, message *protocol.Message) error {
+	return pushMessageToSessions(userID, nil, nil, message)
+}
 
-	err, _, opCode, _ := readPacketFromSubscriber(msg.ID, 0)
+func pushMessageToSessions(userID uint64, only, except *protocol.Conn, message *protocol.Message) error {
+	if message.Timestamp == 0 {
+		message.Timestamp = protocol.Timestamp(time.Now())
+	}
+	data, err := message.Marshal()
 	if err != nil {
 		fmt.Println(err.Error())
+		return err
 	}
-
-	switch opCode {
-	case 200:
-		return
-	case 400:
-		fmt.Println("Bad syntax???")
-	case 404:
-		fmt.Println("Wrong receipient")
-	default:
-		fmt.Println("Unknown response")
-	}
-}
-
-func getGroupNamebyID(id uint64) (string, error) {
-	var (
-		group groupStruct
-		name  string
-	)
-	appDB.First(&group, "id = ?", id)
-	if reflect.DeepEqual(group, groupStruct{}) {
-		return "", errors.New("User doesn't exists")
-	} else {
-		name = group.Verbose
-		return name, nil
-	}
+	return sendPacketToSessions(userID, only, except, protocol.OpMessage, data)
 }
 
 //
 //
-// etc
+// Message storage and delivery receipts
 //
 //
 
-func isOnline(user uint64) bool {
-	if subscription[user] != nil {
-		return true
+// storeMessage records a message sent by a user and returns its ID
+func storeMessage(senderID, userID, groupID uint64, body string) uint64 {
+	message := messageStruct{SenderID: senderID, UserID: userID, GroupID: groupID, Body: body, CreatedAt: time.Now().UTC()}
+	err := appDB.Create(&message).Error
+	if err != nil {
+		fmt.Println(err.Error())
+		return 0
 	}
-	return false
+	return message.ID
 }
 
-//
-//
-// Parser
-//
-//
-type parserStruct struct {
-	data   []byte
-	length uint16
-	offset uint16
-}
-
-func (obj *parserStruct) Byte() (byte, error) {
-	if obj.offset+1 > obj.length {
-		return 0, errors.New("Offset is out of range")
+// messageTime returns the time of a stored message, now for the others
+func messageTime(messageID uint64) time.Time {
+	if messageID != 0 {
+		var message messageStruct
+		appDB.First(&message, "id = ?", messageID)
+		if message.ID != 0 {
+			return message.CreatedAt
+		}
 	}
-	defer incrementOffset(1, obj)
-	return byte(obj.data[obj.offset]), nil
+	return time.Now().UTC()
 }
 
-func (obj *parserStruct) UInt16() (uint16, error) {
-	if obj.offset+2 > obj.length {
-		return 0, errors.New("Offset is out of range")
+func replyMessageID(client *protocol.Conn, packet *protocol.Packet, messageID uint64, status protocol.OpCode) {
+	if messageID == 0 {
+		client.Reply(packet, status, nil)
+		return
 	}
-	defer incrementOffset(2, obj)
-	return binary.LittleEndian.Uint16(obj.data[obj.offset : obj.offset+2]), nil
+	response := protocol.MessageResponse{MessageID: messageID, Timestamp: protocol.Timestamp(messageTime(messageID))}
+	data, _ := response.Marshal()
+	client.Reply(packet, status, data)
 }
 
-func (obj *parserStruct) UInt32() (uint32, error) {
-	if obj.offset+4 > obj.length {
-		return 0, errors.New("Offset is out of range")
+// addReceipt records a recipient of a stored message. Messages which could not
+// be pushed are queued until the recipient subscribes. Returns true if queued.
+func addReceipt(messageID, userID uint64, queued bool) bool {
+	if messageID == 0 {
+		return false
 	}
-	defer incrementOffset(4, obj)
-	return binary.LittleEndian.Uint32(obj.data[obj.offset : obj.offset+4]), nil
+	appDB.Create(&receiptStruct{MessageID: messageID, UserID: userID, State: protocol.ReceiptSent, Queued: queued})
+	return queued
 }
 
-func (obj *parserStruct) UInt64() (uint64, error) {
-	if obj.offset+8 > obj.length {
-		return 0, errors.New("Offset is out of range")
+// flushQueue pushes the messages queued while the user was offline and the
+// ones the user never acknowledged, which were lost with a closed or full
+// outbox, in the order they were sent. The client ignores the ones it has.
+func flushQueue(userID uint64) {
+	var receipts []receiptStruct
+	appDB.Order("message_id").Find(&receipts, "user_id = ? AND (queued = ? OR state = ?)", userID, true, protocol.ReceiptSent)
+	for _, receipt := range receipts {
+		var message messageStruct
+		appDB.First(&message, "id = ?", receipt.MessageID)
+		if message.ID != 0 {
+			push := protocol.Message{SenderID: message.SenderID, UserID: message.UserID, GroupID: message.GroupID, Text: message.Body, MessageID: message.ID, Timestamp: protocol.Timestamp(message.CreatedAt)}
+			if pushMessage(userID, &push) != nil {
+				return // Still offline, the rest waits for the next subscription
+			}
+		}
+		appDB.Model(&receipt).Update("queued", false)
 	}
-	defer incrementOffset(8, obj)
-	return binary.LittleEndian.Uint64(obj.data[obj.offset : obj.offset+8]), nil
 }
 
-func (obj *parserStruct) String(len uint16) (string, error) {
-	if obj.offset+len > obj.length {
-		return "", errors.New("Offset is out of range")
+// updateReceipt stores the state acknowledged by the recipient and tells the
+// sender about it. States only move forward, from delivered to read.
+func updateReceipt(messageID, userID uint64, state byte) {
+	var receipt receiptStruct
+	appDB.First(&receipt, "message_id = ? AND user_id = ?", messageID, userID)
+	if receipt.ID == 0 || receipt.State >= state {
+		return
 	}
-	defer incrementOffset(len, obj)
-	return string(obj.data[obj.offset : obj.offset+len]), nil
-}
+	appDB.Model(&receipt).Update("state", state)
 
-func (obj *parserStruct) Chunk(len uint16) ([]byte, error) {
-	if obj.offset+len > obj.length {
-		return nil, errors.New("Offset is out of range")
+	var message messageStruct
+	appDB.First(&message, "id = ?", messageID)
+	if message.ID == 0 {
+		return
 	}
-	defer incrementOffset(len, obj)
-	return obj.data[obj.offset : obj.offset+len], nil
-}
-
-func incrementOffset(count uint16, obj *parserStruct) {
-	obj.offset += count
-}
-
-//
-//
-// Serializer
-//
-//
-func createSerializer() serializerStruct {
-	var buffer bytes.Buffer
-	obj := serializerStruct{buffer}
-	return obj
-}
-
-type serializerStruct struct {
-	buffer bytes.Buffer
+	push := protocol.Receipt{MessageID: messageID, UserID: userID, State: state}
+	data, _ := push.Marshal()
+	sendPacketToSubscriber(message.SenderID, protocol.OpReceipt, data)
 }
 
-func (obj *serializerStruct) Byte(input byte) error {
-	err := obj.buffer.WriteByte(input)
-	if err != nil {
-		return err
+// getHistory returns a page of the stored messages of a chat of the user,
+// from the oldest to the newest
+func getHistory(clID uint64, request *protocol.HistoryRequest) ([]protocol.HistoryEntry, error) {
+	limit := int(request.Limit)
+	if limit == 0 || limit > HISTORYPAGESIZE {
+		limit = HISTORYPAGESIZE
 	}
-	return nil
-}
-
-func (obj *serializerStruct) UInt16(input uint16) error {
-	temp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(temp, input)
-	_, err := obj.buffer.Write(temp)
-	if err != nil {
-		return err
+	query := appDB.Order("id desc").Limit(limit)
+	if request.BeforeID != 0 {
+		query = query.Where("id < ?", request.BeforeID)
 	}
-	return nil
-}
-
-func (obj *serializerStruct) UInt32(input uint32) error {
-	temp := make([]byte, 4)
-	binary.LittleEndian.PutUint32(temp, input)
-	_, err := obj.buffer.Write(temp)
-	if err != nil {
-		return err
+	if request.GroupID != 0 {
+		query = query.Where("group_id = ?", request.GroupID)
+	} else {
+		query = query.Where("(sender_id = ? AND user_id = ?) OR (sender_id = ? AND user_id = ?)", clID, request.UserID, request.UserID, clID)
+	}
+	var messages []messageStruct
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, err
 	}
-	return nil
-}
 
-func (obj *serializerStruct) UInt64(input uint64) error {
-	temp := make([]byte, 8)
-	binary.LittleEndian.PutUint64(temp, input)
-	_, err := obj.buffer.Write(temp)
-	if err != nil {
-		return err
+	history := make([]protocol.HistoryEntry, len(messages))
+	entries := make(map[uint64]*protocol.HistoryEntry, len(messages))
+	ids := make([]uint64, len(messages))
+	for i, message := range messages {
+		entry := &history[len(messages)-1-i]
+		entry.Message = protocol.Message{SenderID: message.SenderID, UserID: message.UserID, GroupID: message.GroupID, Text: message.Body, MessageID: message.ID, Timestamp: protocol.Timestamp(message.CreatedAt)}
+		entries[message.ID] = entry
+		ids[i] = message.ID
+	}
+	if len(ids) == 0 {
+		return history, nil
 	}
-	return nil
-}
 
-func (obj *serializerStruct) String(input string, lenLen int) error {
-	inputB := []byte(input)
-	len := len(inputB)
-	if lenLen == 1 {
-		err := obj.buffer.WriteByte(byte(len))
-		if err != nil {
-			return err
-		}
-	} else if lenLen == 2 {
-		err := obj.UInt16(uint16(len))
-		if err != nil {
-			return err
+	// The sender sees the furthest state among the recipients, a recipient
+	// sees its own
+	var receipts []receiptStruct
+	if err := appDB.Where("message_id IN (?)", ids).Find(&receipts).Error; err != nil {
+		return nil, err
+	}
+	for _, receipt := range receipts {
+		entry := entries[receipt.MessageID]
+		if entry.Message.SenderID != clID && receipt.UserID != clID {
+			continue
 		}
-	} else {
-		err := obj.UInt32(uint32(len))
-		if err != nil {
-			return err
+		if receipt.State > entry.State {
+			entry.State = receipt.State
 		}
 	}
-	_, err := obj.buffer.Write(inputB)
-	if err != nil {
-		return err
-	}
-	return nil
+	return history, nil
 }
 
-func (obj *serializerStruct) Chunk(input []byte, lenLen int) error {
-	len := len(input)
-	if lenLen == 1 {
-		err := obj.buffer.WriteByte(byte(len))
-		if err != nil {
-			return err
-		}
-	} else if lenLen == 2 {
-		err := obj.UInt16(uint16(len))
-		if err != nil {
-			return err
-		}
+func getGroupNamebyID(id uint64) (string, error) {
+	var (
+		group groupStruct
+		name  string
+	)
+	appDB.First(&group, "id = ?", id)
+	if reflect.DeepEqual(group, groupStruct{}) {
+		return "", errors.New("User doesn't exists")
 	} else {
-		err := obj.UInt32(uint32(len))
-		if err != nil {
-			return err
-		}
-	}
-	_, err := obj.buffer.Write(input)
-	if err != nil {
-		return err
+		name = group.Verbose
+		return name, nil
 	}
-	return nil
+}
+
+//
+//
+// etc
+//
+//
+
+func isOnline(user uint64) bool {
+	return registry.online(user)
+}
+
+func isGroupMember(user uint64, group uint64) bool {
+	var groupMem groupMemberStruct
+	appDB.First(&groupMem, "group_id = ? AND user_id = ?", group, user)
+	return groupMem.ID != 0
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+)
+
+// groupRole is the role of a member of a group, stored in groupMemberStruct.
+// A higher role can do everything a lower one can.
+type groupRole int
+
+const (
+	roleNone      groupRole = iota - 1 // Not a member
+	roleMember                         // Stored as 0, the default of the column
+	roleModerator                      // Invites and kicks members
+	roleAdmin                          // Promotes and demotes, renames the group
+	roleOwner                          // A single one, deletes the group and passes the ownership
+)
+
+var roleNames = map[groupRole]string{roleMember: "member", roleModerator: "moderator", roleAdmin: "admin", roleOwner: "owner"}
+
+// permission is something a command does to a group
+type permission int
+
+const (
+	permChat       permission = iota // /help /list /leave
+	permAdd                          // Invite users
+	permKick                         // Remove members of a lower role
+	permPromote                      // Change the roles below the own one
+	permRename                       // Rename the group and set its topic
+	permVisibility                   // Make the group public or private
+	permDelete                       // Delete the group
+	permGrant                        // Pass the ownership
+)
+
+// permissions is the lowest role having each permission
+var permissions = map[permission]groupRole{
+	permChat:       roleMember,
+	permAdd:        roleModerator,
+	permKick:       roleModerator,
+	permPromote:    roleAdmin,
+	permRename:     roleAdmin,
+	permVisibility: roleAdmin,
+	permDelete:     roleOwner,
+	permGrant:      roleOwner,
+}
+
+func (obj groupRole) can(perm permission) bool {
+	return obj >= permissions[perm]
+}
+
+// commandArg is an argument of a group command. A rest argument takes the
+// rest of the line, spaces included. An optional argument is "" if left
+// out. Only the last argument can be either.
+type commandArg struct {
+	name     string
+	rest     bool
+	optional bool
+}
+
+// groupCommand is a slash command of the groups. It is run from the chat text
+// (opcode 1) or with OpGroupCommand.
+type groupCommand struct {
+	name       string
+	args       []commandArg
+	permission permission
+	help       string
+	handler    func(ctx *commandContext) error
+}
+
+// commandContext is a single run of a command
+type commandContext struct {
+	clID    uint64
+	client  *protocol.Conn
+	group   groupStruct
+	role    groupRole
+	args    []string
+	replies []string // Shown only to the caller
+}
+
+// commandError is a command which failed, its text is shown to the caller
+type commandError struct {
+	status protocol.OpCode
+	text   string
+}
+
+func (obj *commandError) Error() string {
+	return obj.text
+}
+
+// rejected fails a command which can't be done with these arguments
+func rejected(text string) error {
+	return &commandError{protocol.StatusNotAcceptable, text}
+}
+
+var (
+	groupCommands     = make(map[string]*groupCommand)
+	groupCommandOrder []*groupCommand // Order of /help
+)
+
+func registerCommand(command *groupCommand) {
+	groupCommands[command.name] = command
+	groupCommandOrder = append(groupCommandOrder, command)
+}
+
+// registerAlias makes a command run under another name too, the alias is not
+// listed in /help
+func registerAlias(alias, name string) {
+	groupCommands[alias] = groupCommands[name]
+}
+
+func init() {
+	username := []commandArg{{name: "username"}}
+	registerCommand(&groupCommand{name: "help", permission: permChat, help: "show this help", handler: commandHelp})
+	registerCommand(&groupCommand{name: "list", permission: permChat, help: "list the members of the group", handler: commandList})
+	registerCommand(&groupCommand{name: "leave", permission: permChat, help: "leave the group", handler: commandLeave})
+	registerCommand(&groupCommand{name: "invite", args: username, permission: permAdd, help: "invite a user to the group", handler: commandInvite})
+	registerAlias("add", "invite") // /add joined the user right away before the invitations
+	registerCommand(&groupCommand{name: "kick", args: username, permission: permKick, help: "remove a member from the group", handler: commandKick})
+	registerCommand(&groupCommand{name: "promote", args: username, permission: permPromote, help: "raise the role of a member: moderator, admin", handler: commandPromote})
+	registerCommand(&groupCommand{name: "demote", args: username, permission: permPromote, help: "lower the role of a member", handler: commandDemote})
+	registerCommand(&groupCommand{name: "visibility", args: []commandArg{{name: "public|private"}}, permission: permVisibility, help: "make the group public or private", handler: commandVisibility})
+	registerCommand(&groupCommand{name: "rename", args: []commandArg{{name: "name", rest: true}}, permission: permRename, help: "rename the group", handler: commandRename})
+	registerCommand(&groupCommand{name: "topic", args: []commandArg{{name: "text", rest: true, optional: true}}, permission: permRename, help: "set the topic of the group, clear it without text", handler: commandTopic})
+	registerCommand(&groupCommand{name: "grant", args: username, permission: permGrant, help: "pass the ownership of the group to a member", handler: commandGrant})
+	registerCommand(&groupCommand{name: "delete", args: []commandArg{{name: "group name", rest: true}}, permission: permDelete, help: "delete the group for all members", handler: commandDelete})
+}
+
+func (obj *groupCommand) usage() string {
+	usage := "/" + obj.name
+	for _, arg := range obj.args {
+		if arg.optional {
+			usage += " [" + arg.name + "]"
+		} else {
+			usage += " <" + arg.name + ">"
+		}
+	}
+	return usage
+}
+
+// helpText lists the commands a user with the role can run
+func helpText(role groupRole) string {
+	text := "Commands:"
+	for _, command := range groupCommandOrder {
+		if !role.can(command.permission) {
+			continue
+		}
+		text += "\n" + command.usage() + " - " + command.help
+		if required := permissions[command.permission]; required > roleMember {
+			text += " (" + roleNames[required] + ")"
+		}
+	}
+	return text
+}
+
+func roleOf(userID uint64, group *groupStruct) groupRole {
+	var groupMem groupMemberStruct
+	appDB.First(&groupMem, "group_id = ? AND user_id = ?", group.ID, userID)
+	if groupMem.ID == 0 {
+		return roleNone
+	}
+	return groupMem.Role
+}
+
+// parseCommand splits chat text into a registered command and its arguments.
+// Returns nil for text which is no command.
+func parseCommand(text string) (*groupCommand, []string) {
+	if !strings.HasPrefix(text, "/") {
+		return nil, nil
+	}
+	fields := strings.Fields(text[1:])
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	command, ok := groupCommands[fields[0]]
+	if !ok {
+		return nil, nil
+	}
+	return command, fields[1:]
+}
+
+// runCommand checks the role of the caller and the arguments and runs the
+// command. Failures are *commandError, or other errors of the server.
+func runCommand(command *groupCommand, clID uint64, client *protocol.Conn, groupID uint64, args []string) (*commandContext, error) {
+	var group groupStruct
+	appDB.First(&group, "id = ?", groupID)
+	if group.ID == 0 {
+		// Not 404, which tells the client that the command is unknown
+		return nil, &commandError{protocol.StatusForbidden, "The group doesn't exist"}
+	}
+	ctx := &commandContext{clID: clID, client: client, group: group, role: roleOf(clID, &group)}
+	if !ctx.role.can(command.permission) {
+		if ctx.role == roleNone {
+			return ctx, &commandError{protocol.StatusForbidden, "You are not the member of the group"}
+		}
+		return ctx, &commandError{protocol.StatusForbidden, "/" + command.name + " needs the role " + roleNames[permissions[command.permission]]}
+	}
+
+	if n := len(command.args); n > 0 && command.args[n-1].rest && len(args) > n {
+		args = append(args[:n-1:n-1], strings.Join(args[n-1:], " "))
+	}
+	if n := len(command.args); n > 0 && command.args[n-1].optional && len(args) == n-1 {
+		args = append(args[:n-1:n-1], "")
+	}
+	if len(args) != len(command.args) {
+		return ctx, &commandError{protocol.StatusBadRequest, "Usage: " + command.usage()}
+	}
+	for i, arg := range args {
+		if arg == "" && !command.args[i].optional {
+			return ctx, &commandError{protocol.StatusBadRequest, "Usage: " + command.usage()}
+		}
+	}
+	ctx.args = args
+	return ctx, command.handler(ctx)
+}
+
+func (obj *commandContext) reply(text string) {
+	obj.replies = append(obj.replies, text)
+}
+
+// announce tells the members about a change of the group, the announcement
+// is stored like the messages of the users
+func (obj *commandContext) announce(text string) {
+	sendMessage(&msgStruct{nil, text, true, obj.group.ID, 1, 0})
+}
+
+// user looks the argument up as a user who is not in the group
+func (obj *commandContext) user(username string) (uint64, error) {
+	userID, err := getUserIDbyName([]byte(username))
+	if err != nil {
+		return 0, rejected(username + " doesn't exist")
+	}
+	if isGroupMember(userID, obj.group.ID) {
+		return 0, rejected(username + " already in group")
+	}
+	return userID, nil
+}
+
+// member looks the argument up as a member of the group
+func (obj *commandContext) member(username string) (*groupMemberStruct, error) {
+	userID, err := getUserIDbyName([]byte(username))
+	if err != nil {
+		return nil, rejected(username + " doesn't exist")
+	}
+	var groupMem groupMemberStruct
+	appDB.First(&groupMem, "group_id = ? AND user_id = ?", obj.group.ID, userID)
+	if groupMem.ID == 0 {
+		return nil, rejected(username + " not in group")
+	}
+	return &groupMem, nil
+}
+
+// setRole changes the role of a member and announces it
+func (obj *commandContext) setRole(groupMem *groupMemberStruct, role groupRole) {
+	appDB.Model(groupMem).Update("role", role)
+	obj.announce(groupMem.Username + " is now " + roleNames[role] + " of the group")
+}
+
+//
+// Commands
+//
+
+func commandHelp(ctx *commandContext) error {
+	ctx.reply(helpText(ctx.role))
+	return nil
+}
+
+func commandList(ctx *commandContext) error {
+	list, err := memberList(&ctx.group)
+	if err != nil {
+		return err
+	}
+	ctx.reply("List of users in group" + list)
+	return nil
+}
+
+func commandLeave(ctx *commandContext) error {
+	if ctx.role == roleOwner {
+		return rejected("You can't leave group without owner, use /grant and then /leave")
+	}
+	username, err := getNamebyUserID(ctx.clID)
+	if err != nil {
+		return err
+	}
+	appDB.Delete(groupMemberStruct{}, "group_id = ? AND user_id = ?", ctx.group.ID, ctx.clID)
+	ctx.announce(username + " left the group")
+	return nil
+}
+
+func commandKick(ctx *commandContext) error {
+	groupMem, err := ctx.member(ctx.args[0])
+	if err != nil {
+		return err
+	}
+	if groupMem.UserID == ctx.clID {
+		return rejected("You can't delete yourself, use /leave")
+	}
+	if groupMem.Role >= ctx.role {
+		return rejected("You can kick only members with a lower role")
+	}
+	// The kicked user still sees the announcement
+	ctx.announce(groupMem.Username + " was deleted from the group")
+	appDB.Delete(groupMemberStruct{}, "id = ?", groupMem.ID)
+	return nil
+}
+
+func commandPromote(ctx *commandContext) error {
+	groupMem, err := ctx.member(ctx.args[0])
+	if err != nil {
+		return err
+	}
+	if groupMem.Role+1 >= ctx.role || groupMem.Role+1 >= roleOwner {
+		return rejected("You can't promote " + groupMem.Username + " above " + roleNames[groupMem.Role])
+	}
+	ctx.setRole(groupMem, groupMem.Role+1)
+	return nil
+}
+
+func commandDemote(ctx *commandContext) error {
+	groupMem, err := ctx.member(ctx.args[0])
+	if err != nil {
+		return err
+	}
+	if groupMem.Role >= ctx.role {
+		return rejected("You can demote only members with a lower role")
+	}
+	if groupMem.Role == roleMember {
+		return rejected(groupMem.Username + " is already member")
+	}
+	ctx.setRole(groupMem, groupMem.Role-1)
+	return nil
+}
+
+// commandGrant passes the ownership, the previous owner stays an admin
+func commandGrant(ctx *commandContext) error {
+	groupMem, err := ctx.member(ctx.args[0])
+	if err != nil {
+		return err
+	}
+	if groupMem.UserID == ctx.clID {
+		return rejected("You can't /grant to yourself")
+	}
+	tx := appDB.Begin()
+	err = tx.Model(&ctx.group).Update("owner_id", groupMem.UserID).Error
+	if err == nil {
+		err = tx.Model(&groupMemberStruct{}).Where("group_id = ? AND user_id = ?", ctx.group.ID, ctx.clID).Update("role", roleAdmin).Error
+	}
+	if err == nil {
+		err = tx.Model(groupMem).Update("role", roleOwner).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	ctx.announce(groupMem.Username + " is now owner of the group")
+	return nil
+}
+
+// memberList returns the members of the group with their online state and
+// role, one per line
+func memberList(group *groupStruct) (string, error) {
+	rows, err := appDB.Raw("SELECT user_id, username, role FROM group_member_structs WHERE group_id = ? ORDER BY role DESC, id", group.ID).Rows()
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	list := ""
+	counter := 1
+	for rows.Next() {
+		var (
+			userID   uint64
+			username string
+			role     groupRole
+		)
+		if err := rows.Scan(&userID, &username, &role); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		list += "\n" + strconv.Itoa(counter) + ". "
+		if isOnline(userID) {
+			list += " 🔵 "
+		} else {
+			list += " 🌑 "
+		}
+		list += username
+		if role == roleOwner {
+			list += " 👑"
+		} else if role > roleMember {
+			list += " (" + roleNames[role] + ")"
+		}
+		counter++
+	}
+	return list, nil
+}
+
+// commandReplies returns the texts for the caller of a command which ended
+// with err
+func commandReplies(ctx *commandContext, err error) []string {
+	var replies []string
+	if ctx != nil {
+		replies = ctx.replies
+	}
+	if _, ok := err.(*commandError); ok {
+		replies = append(replies, err.Error())
+	} else if err != nil {
+		fmt.Println(err.Error())
+		replies = append(replies, "Server error")
+	}
+	return replies
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	//SEARCHLIMIT Biggest count of groups returned by a search
+	SEARCHLIMIT = 50
+	//TOPICLENGTH Biggest size of the topic of a group in bytes
+	TOPICLENGTH = 1000
+)
+
+// searchGroups returns the public groups whose name contains the query, the
+// biggest first
+func searchGroups(query string) ([]protocol.GroupInfo, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	rows, err := appDB.Raw(`SELECT g.id, g.verbose, COUNT(m.id) FROM group_structs g LEFT JOIN group_member_structs m ON m.group_id = g.id
+		WHERE g.public = ? AND g.verbose LIKE ? ESCAPE '\' GROUP BY g.id, g.verbose ORDER BY COUNT(m.id) DESC, g.verbose LIMIT ?`, true, pattern, SEARCHLIMIT).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []protocol.GroupInfo
+	for rows.Next() {
+		var group protocol.GroupInfo
+		if err := rows.Scan(&group.GroupID, &group.Name, &group.Members); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// joinGroup makes the user a member of the group, the invitations to it are
+// not needed anymore
+func joinGroup(userID, groupID uint64) error {
+	username, err := getNamebyUserID(userID)
+	if err != nil {
+		return err
+	}
+	tx := appDB.Begin()
+	err = tx.Delete(inviteStruct{}, "group_id = ? AND user_id = ?", groupID, userID).Error
+	if err == nil && !isGroupMember(userID, groupID) {
+		err = tx.Create(&groupMemberStruct{UserID: userID, GroupID: groupID, Username: username}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	go sendMessage(&msgStruct{nil, username + " joined the group", true, groupID, 1, 0})
+	go sendHelloFromGroup(userID, groupID, nil)
+	return nil
+}
+
+func commandVisibility(ctx *commandContext) error {
+	var public bool
+	switch ctx.args[0] {
+	case "public":
+		public = true
+	case "private":
+	default:
+		return &commandError{protocol.StatusBadRequest, "Usage: /visibility public|private"}
+	}
+	if ctx.group.Public == public {
+		return rejected("The group is already " + ctx.args[0])
+	}
+	appDB.Model(&ctx.group).Update("public", public)
+	ctx.announce("The group is now " + ctx.args[0])
+	return nil
+}
+
+// normalizeGroupName drops the spaces around the words of a group name and
+// leaves single spaces between them, as the arguments of the commands have
+func normalizeGroupName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func commandRename(ctx *commandContext) error {
+	name := normalizeGroupName(ctx.args[0])
+	if name == "" {
+		return rejected("The name is empty")
+	}
+	if len(name) > 255 {
+		return rejected("The name is too long")
+	}
+	if name == ctx.group.Verbose {
+		return rejected("The group already has this name")
+	}
+	var group groupStruct
+	appDB.First(&group, "verbose = ?", name)
+	if group.ID != 0 {
+		return &commandError{protocol.StatusConflict, "Group with this name already exists"}
+	}
+	if err := appDB.Model(&ctx.group).Update("verbose", name).Error; err != nil {
+		return err
+	}
+	username, _ := getNamebyUserID(ctx.clID)
+	ctx.announce(username + " renamed the group to " + name)
+	pushGroupChanged(&ctx.group)
+	return nil
+}
+
+// commandTopic sets the topic shown in the header of the chat, no text
+// clears it
+func commandTopic(ctx *commandContext) error {
+	topic := ctx.args[0]
+	if len(topic) > TOPICLENGTH {
+		return rejected("The topic is too long")
+	}
+	if topic == ctx.group.Topic {
+		return rejected("The topic is already set")
+	}
+	if err := appDB.Model(&ctx.group).Update("topic", topic).Error; err != nil {
+		return err
+	}
+	username, _ := getNamebyUserID(ctx.clID)
+	if topic == "" {
+		ctx.announce(username + " cleared the topic")
+	} else {
+		ctx.announce(username + " set the topic: " + topic)
+	}
+	pushGroupChanged(&ctx.group)
+	return nil
+}
+
+// commandDelete deletes the group, the name of the group is asked as the
+// argument so it isn't deleted by mistake
+func commandDelete(ctx *commandContext) error {
+	// Groups created before the names were normalized are deleted too
+	if normalizeGroupName(ctx.args[0]) != normalizeGroupName(ctx.group.Verbose) {
+		return rejected("Type the name of the group after /delete to delete it")
+	}
+	var members []uint64
+	appDB.Model(&groupMemberStruct{}).Where("group_id = ?", ctx.group.ID).Pluck("user_id", &members)
+
+	// The last message of the group, queued for the members who are offline
+	username, _ := getNamebyUserID(ctx.clID)
+	ctx.announce(username + " deleted the group")
+
+	tx := appDB.Begin()
+	if err := deleteGroupRecords(tx, ctx.group.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	data, err := groupChanged(&ctx.group, true)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		sendPacketToSubscriber(member, protocol.OpGroupChanged, data)
+	}
+	return nil
+}
+
+// deleteGroupRecords removes the group with its members and invitations, the
+// messages stay in the history
+func deleteGroupRecords(tx *gorm.DB, groupID uint64) error {
+	if err := tx.Delete(inviteStruct{}, "group_id = ?", groupID).Error; err != nil {
+		return err
+	}
+	if err := tx.Delete(groupMemberStruct{}, "group_id = ?", groupID).Error; err != nil {
+		return err
+	}
+	return tx.Delete(groupStruct{}, "id = ?", groupID).Error
+}
+
+func groupChanged(group *groupStruct, deleted bool) ([]byte, error) {
+	push := protocol.GroupChanged{GroupID: group.ID, Name: group.Verbose, Topic: group.Topic, Deleted: deleted}
+	return push.Marshal()
+}
+
+// pushGroupChanged tells the members about the new name or topic of the group
+func pushGroupChanged(group *groupStruct) {
+	data, err := groupChanged(group, false)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	var members []uint64
+	appDB.Model(&groupMemberStruct{}).Where("group_id = ?", group.ID).Pluck("user_id", &members)
+	for _, member := range members {
+		sendPacketToSubscriber(member, protocol.OpGroupChanged, data)
+	}
+}
+
+// sendGroupInfo pushes the name and topic of the group to a member, only to
+// the session of events if it is not nil
+func sendGroupInfo(userID uint64, group *groupStruct, events *protocol.Conn) {
+	data, err := groupChanged(group, false)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	sendPacketToSessions(userID, events, nil, protocol.OpGroupChanged, data)
+}
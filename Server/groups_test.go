@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+	"github.com/jinzhu/gorm"
+)
+
+// testDB replaces appDB with an empty database in memory
+func testDB(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&userStruct{}, &groupStruct{}, &groupMemberStruct{}, &messageStruct{}, &receiptStruct{}, &tokenStruct{}, &inviteStruct{}, &lockoutStruct{})
+	appDB = db
+	t.Cleanup(func() { db.Close() })
+	appDB.Create(&userStruct{Username: "System"})
+}
+
+func testUser(t *testing.T, username string) uint64 {
+	user := userStruct{Username: username}
+	if err := appDB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+// testGroup creates a group and makes the user its owner
+func testGroup(t *testing.T, name string, owner uint64) groupStruct {
+	group := groupStruct{OwnerID: owner, Verbose: name}
+	if err := appDB.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	testMember(t, group.ID, owner, roleOwner)
+	return group
+}
+
+func testMember(t *testing.T, groupID, userID uint64, role groupRole) {
+	username, _ := getNamebyUserID(userID)
+	if err := appDB.Create(&groupMemberStruct{UserID: userID, GroupID: groupID, Username: username, Role: role}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runTestCommand(t *testing.T, userID, groupID uint64, name string, args ...string) error {
+	command, ok := groupCommands[name]
+	if !ok {
+		t.Fatalf("/%s is not registered", name)
+	}
+	_, err := runCommand(command, userID, nil, groupID, args)
+	return err
+}
+
+func TestRenameRejectsEmptyName(t *testing.T) {
+	testDB(t)
+	owner := testUser(t, "alice")
+	group := testGroup(t, "team", owner)
+
+	err := runTestCommand(t, owner, group.ID, "rename", "   ")
+	if cmdErr, ok := err.(*commandError); !ok || cmdErr.status != protocol.StatusNotAcceptable {
+		t.Fatalf("/rename with spaces: %v", err)
+	}
+	appDB.First(&group, group.ID)
+	if group.Verbose != "team" {
+		t.Fatalf("group renamed to %q", group.Verbose)
+	}
+
+	if err := runTestCommand(t, owner, group.ID, "rename", "  new   name "); err != nil {
+		t.Fatal(err)
+	}
+	appDB.First(&group, group.ID)
+	if group.Verbose != "new name" {
+		t.Fatalf("group renamed to %q", group.Verbose)
+	}
+}
+
+// The owner who deletes the account passes the group to the member with the
+// highest role, a group without other members is deleted
+func TestDeleteAccountPassesOwnership(t *testing.T) {
+	testDB(t)
+	owner := testUser(t, "alice")
+	group := testGroup(t, "team", owner)
+	alone := testGroup(t, "alone", owner)
+	testMember(t, group.ID, testUser(t, "bob"), roleMember)
+	testMember(t, group.ID, testUser(t, "carol"), roleAdmin)
+	testMember(t, group.ID, testUser(t, "dave"), roleModerator)
+
+	var user userStruct
+	appDB.First(&user, owner)
+	if err := deleteAccount(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	appDB.First(&group, group.ID)
+	var heir groupMemberStruct
+	appDB.First(&heir, "group_id = ? AND user_id = ?", group.ID, group.OwnerID)
+	if heir.Username != "carol" || heir.Role != roleOwner {
+		t.Fatalf("the group passed to %q as %s", heir.Username, roleNames[heir.Role])
+	}
+	var count int
+	appDB.Model(&groupStruct{}).Where("id = ?", alone.ID).Count(&count)
+	if count != 0 {
+		t.Fatal("the group without other members is not deleted")
+	}
+	appDB.Model(&groupMemberStruct{}).Where("user_id = ?", owner).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d memberships of the deleted user are left", count)
+	}
+}
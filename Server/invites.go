@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+)
+
+//INVITELIFETIME Default time an invitation to a group waits for the answer
+const INVITELIFETIME = 7 * 24 * time.Hour
+
+var (
+	inviteLifetime = INVITELIFETIME
+
+	errNoInvite = errors.New("Invitation doesn't exist or expired")
+)
+
+// Invitation of a user to a group, the membership is created on acceptance
+type inviteStruct struct {
+	ID        uint64 `gorm:"primary_key"`
+	GroupID   uint64 `gorm:"index"`
+	UserID    uint64 `gorm:"index"` // Invited user
+	InviterID uint64
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func commandInvite(ctx *commandContext) error {
+	username := ctx.args[0]
+	userID, err := ctx.user(username)
+	if err != nil {
+		return err
+	}
+	var invite inviteStruct
+	appDB.First(&invite, "group_id = ? AND user_id = ? AND expires_at > ?", ctx.group.ID, userID, time.Now())
+	if invite.ID != 0 {
+		return rejected(username + " is already invited")
+	}
+	invite = inviteStruct{GroupID: ctx.group.ID, UserID: userID, InviterID: ctx.clID, ExpiresAt: time.Now().Add(inviteLifetime)}
+	if err := appDB.Create(&invite).Error; err != nil {
+		return err
+	}
+	go pushInvite(&invite, nil)
+	ctx.reply(username + " is invited to the group")
+	return nil
+}
+
+// pushInvite sends the invitation to the invited user, only to the session
+// of events if it is not nil
+func pushInvite(invite *inviteStruct, events *protocol.Conn) {
+	groupName, err := getGroupNamebyID(invite.GroupID)
+	if err != nil {
+		return
+	}
+	inviter, _ := getNamebyUserID(invite.InviterID)
+	push := protocol.Invite{InviteID: invite.ID, GroupID: invite.GroupID, GroupName: groupName, Inviter: inviter, ExpiresAt: protocol.Timestamp(invite.ExpiresAt)}
+	data, err := push.Marshal()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	sendPacketToSessions(invite.UserID, events, nil, protocol.OpInvite, data)
+}
+
+// sendPendingInvites pushes the invitations the user didn't answer yet to
+// the session of a new subscription
+func sendPendingInvites(userID uint64, events *protocol.Conn) {
+	var invites []inviteStruct
+	appDB.Order("id").Find(&invites, "user_id = ? AND expires_at > ?", userID, time.Now())
+	for i := range invites {
+		pushInvite(&invites[i], events)
+	}
+}
+
+// pendingInvite returns the invitation of the user if it didn't expire
+func pendingInvite(userID, inviteID uint64) (*inviteStruct, error) {
+	var invite inviteStruct
+	appDB.First(&invite, "id = ? AND user_id = ?", inviteID, userID)
+	if invite.ID == 0 || invite.ExpiresAt.Before(time.Now()) {
+		return nil, errNoInvite
+	}
+	return &invite, nil
+}
+
+// acceptInvite makes the user a member of the group of the invitation
+func acceptInvite(userID uint64, invite *inviteStruct) error {
+	var group groupStruct
+	appDB.First(&group, "id = ?", invite.GroupID)
+	if group.ID == 0 {
+		appDB.Delete(invite)
+		return errNoInvite
+	}
+	return joinGroup(userID, invite.GroupID)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+)
+
+const (
+	//OUTBOXSIZE Default count of events queued for a subscribed connection
+	OUTBOXSIZE = 256
+	//WRITETIMEOUT Time given to a subscribed connection to take an event
+	WRITETIMEOUT = 30 * time.Second
+)
+
+// Policies for events pushed to a full outbox
+const (
+	policyDisconnect = "disconnect" // The slow consumer is logged out, it resumes and reloads the history
+	policyDrop       = "drop"       // The oldest queued event is dropped
+)
+
+var (
+	errOutboxClosed = errors.New("Subscription is closed")
+	errSlowConsumer = errors.New("Subscription is too slow")
+
+	outboxSize   = OUTBOXSIZE
+	outboxPolicy = policyDisconnect
+
+	// Metrics, served on /debug/vars with -metrics
+	outboxDepth       = expvar.NewInt("outbox_depth") // Events queued on all connections
+	outboxDropped     = expvar.NewInt("outbox_dropped")
+	outboxDisconnects = expvar.NewInt("outbox_disconnects")
+)
+
+func init() {
+	expvar.Publish("outbox_max_depth", expvar.Func(func() interface{} {
+		return registry.maxOutboxDepth()
+	}))
+}
+
+// serveMetrics exposes the expvar metrics over HTTP
+func serveMetrics(address string) {
+	fmt.Println("Metrics on http://" + address + "/debug/vars")
+	err := http.ListenAndServe(address, nil)
+	if err != nil {
+		fmt.Println("Metrics error: " + err.Error())
+	}
+}
+
+type outboundPacket struct {
+	opCode protocol.OpCode
+	data   []byte
+}
+
+// outbox is the bounded queue of events of a subscribed connection. Its own
+// goroutine writes them, so a slow recipient doesn't hold the sender up.
+type outbox struct {
+	conn    *protocol.Conn
+	push    bool // Events are pushed on the command connection
+	packets chan outboundPacket
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newOutbox(conn *protocol.Conn, push bool) *outbox {
+	obj := &outbox{
+		conn:    conn,
+		push:    push,
+		packets: make(chan outboundPacket, outboxSize),
+		done:    make(chan struct{}),
+	}
+	go obj.run()
+	return obj
+}
+
+// send queues an event, applying the policy if the queue is full. Messages
+// lost with a closed queue or dropped are sent again by flushQueue, their
+// receipts stay unacknowledged.
+func (obj *outbox) send(opCode protocol.OpCode, data []byte) error {
+	packet := outboundPacket{opCode, data}
+	for {
+		// A random case is chosen if both are ready, so done is checked first
+		select {
+		case <-obj.done:
+			return errOutboxClosed
+		default:
+		}
+		select {
+		case <-obj.done:
+			return errOutboxClosed
+		case obj.packets <- packet:
+			outboxDepth.Add(1)
+			return nil
+		default:
+		}
+
+		if outboxPolicy != policyDrop {
+			outboxDisconnects.Add(1)
+			fmt.Println("Disconnected slow subscriber", obj.conn.RemoteAddr())
+			obj.close()
+			obj.conn.Close() // The failed read removes the session
+			return errSlowConsumer
+		}
+		select {
+		case <-obj.packets:
+			outboxDepth.Add(-1)
+			outboxDropped.Add(1)
+		default:
+		}
+	}
+}
+
+func (obj *outbox) run() {
+	for {
+		select {
+		case <-obj.done:
+			outboxDepth.Add(-int64(len(obj.packets)))
+			return
+		case packet := <-obj.packets:
+			outboxDepth.Add(-1)
+			obj.conn.SetWriteDeadline(time.Now().Add(WRITETIMEOUT))
+			var err error
+			if obj.push {
+				err = obj.conn.Push(packet.opCode, packet.data)
+			} else {
+				err = obj.conn.SendPacket(packet.opCode, packet.data)
+			}
+			obj.conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				fmt.Println("Error in message sending: " + err.Error())
+				obj.close()
+				obj.conn.Close()
+			}
+		}
+	}
+}
+
+func (obj *outbox) close() {
+	obj.once.Do(func() { close(obj.done) })
+}
+
+func (obj *outbox) depth() int {
+	return len(obj.packets)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+)
+
+// presenceWatches remembers the users asked about with opcode 8, whose
+// changes are pushed in addition to the ones of the related users
+type presenceWatches struct {
+	sync.Mutex
+	watchers map[uint64]map[uint64]bool // [watched user_id] watcher user_ids
+}
+
+var (
+	watches = presenceWatches{watchers: make(map[uint64]map[uint64]bool)}
+
+	// presenceMutex keeps the pushes of the online states in the order of
+	// the changes
+	presenceMutex sync.Mutex
+)
+
+func (obj *presenceWatches) watch(watcher uint64, users []uint64) {
+	obj.Lock()
+	defer obj.Unlock()
+	for _, user := range users {
+		if obj.watchers[user] == nil {
+			obj.watchers[user] = make(map[uint64]bool)
+		}
+		obj.watchers[user][watcher] = true
+	}
+}
+
+// forget drops the watches of a user who went offline
+func (obj *presenceWatches) forget(watcher uint64) {
+	obj.Lock()
+	defer obj.Unlock()
+	for user, watchers := range obj.watchers {
+		delete(watchers, watcher)
+		if len(watchers) == 0 {
+			delete(obj.watchers, user)
+		}
+	}
+}
+
+func (obj *presenceWatches) of(user uint64) []uint64 {
+	obj.Lock()
+	defer obj.Unlock()
+	var watchers []uint64
+	for watcher := range obj.watchers[user] {
+		watchers = append(watchers, watcher)
+	}
+	return watchers
+}
+
+// relatedUsers returns the users who share a group or a direct chat with the
+// user. They see each other's online state.
+func relatedUsers(userID uint64) []uint64 {
+	rows, err := appDB.Raw(`SELECT b.user_id FROM group_member_structs a JOIN group_member_structs b ON a.group_id = b.group_id WHERE a.user_id = ?
+		UNION SELECT user_id FROM message_structs WHERE sender_id = ? AND user_id != 0
+		UNION SELECT sender_id FROM message_structs WHERE user_id = ?`, userID, userID, userID).Rows()
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil
+	}
+	defer rows.Close()
+	var users []uint64
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		if id != userID && id != 1 {
+			users = append(users, id)
+		}
+	}
+	return users
+}
+
+// presenceChanged pushes the online state of the user to the related users
+// and the users watching it after a change. The state is read when it is
+// pushed, so a late push of a quick reconnect doesn't overwrite a newer one.
+func presenceChanged(userID uint64) {
+	related := relatedUsers(userID)
+
+	presenceMutex.Lock()
+	defer presenceMutex.Unlock()
+	online := isOnline(userID)
+	if !online {
+		watches.forget(userID)
+	}
+	response := protocol.CheckOnlineResponse{Users: []protocol.OnlineStatus{{UserID: userID, Online: online}}}
+	data, err := response.Marshal()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	notified := make(map[uint64]bool)
+	for _, watcher := range append(related, watches.of(userID)...) {
+		if notified[watcher] {
+			continue
+		}
+		notified[watcher] = true
+		sendPacketToSubscriber(watcher, protocol.OpCheckOnline, data)
+	}
+}
+
+// sendPresenceSnapshot pushes the online state of the related users to the
+// session of a new subscription
+func sendPresenceSnapshot(userID uint64, events *protocol.Conn) {
+	var response protocol.CheckOnlineResponse
+	for _, id := range relatedUsers(userID) {
+		response.Users = append(response.Users, protocol.OnlineStatus{UserID: id, Online: isOnline(id)})
+	}
+	if len(response.Users) == 0 {
+		return
+	}
+	data, err := response.Marshal()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	sendPacketToSessions(userID, events, nil, protocol.OpCheckOnline, data)
+}
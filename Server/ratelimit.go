@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	//LOGINBACKOFF Delay after the first failed login, doubled by every next failure
+	LOGINBACKOFF = time.Second
+	//LOGINMAXFAILURES Failed logins in a row which lock the username or the IP out
+	LOGINMAXFAILURES = 5
+	//LOCKOUTTIME Duration of a lockout, failures are also forgotten after it
+	LOCKOUTTIME = 15 * time.Minute
+)
+
+// Audit record of a lockout
+type lockoutStruct struct {
+	ID        uint64 `gorm:"primary_key"`
+	Username  string
+	IP        string
+	Until     time.Time
+	CreatedAt time.Time
+}
+
+type loginAttempts struct {
+	failures int
+	next     time.Time // No attempt is accepted before
+}
+
+// loginLimiter tracks failed logins per username and per remote IP
+type loginLimiter struct {
+	sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+var limiter = loginLimiter{attempts: make(map[string]*loginAttempts)}
+
+// wait returns how long the client has to wait before its next attempt
+func (obj *loginLimiter) wait(keys ...string) time.Duration {
+	obj.Lock()
+	defer obj.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		attempts, ok := obj.attempts[key]
+		if !ok {
+			continue
+		}
+		if now.Sub(attempts.next) > LOCKOUTTIME {
+			delete(obj.attempts, key)
+			continue
+		}
+		if d := attempts.next.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// failed counts a failed attempt and returns true if it locked the key out
+func (obj *loginLimiter) failed(key string) bool {
+	obj.Lock()
+	defer obj.Unlock()
+	attempts, ok := obj.attempts[key]
+	if !ok {
+		attempts = &loginAttempts{}
+		obj.attempts[key] = attempts
+	}
+	attempts.failures++
+	if attempts.failures >= LOGINMAXFAILURES {
+		attempts.failures = 0
+		attempts.next = time.Now().Add(LOCKOUTTIME)
+		return true
+	}
+	attempts.next = time.Now().Add(LOGINBACKOFF << uint(attempts.failures-1))
+	return false
+}
+
+func (obj *loginLimiter) succeeded(keys ...string) {
+	obj.Lock()
+	defer obj.Unlock()
+	for _, key := range keys {
+		delete(obj.attempts, key)
+	}
+}
+
+// loginWait returns how long a login of the user from the IP has to wait
+func loginWait(username, ip string) time.Duration {
+	return limiter.wait("user:"+username, "ip:"+ip)
+}
+
+// loginFailed counts a failed login and audits the lockouts. The username is
+// "" if the user doesn't exist.
+func loginFailed(username, ip string) {
+	if username != "" && limiter.failed("user:"+username) {
+		auditLockout(username, "")
+	}
+	if limiter.failed("ip:" + ip) {
+		auditLockout("", ip)
+	}
+}
+
+func loginSucceeded(username, ip string) {
+	limiter.succeeded("user:"+username, "ip:"+ip)
+}
+
+func auditLockout(username, ip string) {
+	until := time.Now().Add(LOCKOUTTIME)
+	fmt.Printf("Lockout of user %q ip %q until %s\n", username, ip, until.Format(time.RFC3339))
+	appDB.Create(&lockoutStruct{Username: username, IP: ip, Until: until})
+}
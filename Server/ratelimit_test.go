@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// near reports whether the wait is d, less the time the test took since
+func near(wait, d time.Duration) bool {
+	return wait <= d && wait > d-time.Second/10
+}
+
+// Every failed login doubles the wait for the next attempt
+func TestLoginBackoffDoubles(t *testing.T) {
+	limiter := loginLimiter{attempts: make(map[string]*loginAttempts)}
+	if wait := limiter.wait("user:bob"); wait != 0 {
+		t.Fatalf("wait %s before any failure", wait)
+	}
+	for failures := 1; failures < LOGINMAXFAILURES; failures++ {
+		if limiter.failed("user:bob") {
+			t.Fatalf("locked out after %d failures", failures)
+		}
+		want := LOGINBACKOFF << uint(failures-1)
+		if wait := limiter.wait("user:bob"); !near(wait, want) {
+			t.Fatalf("wait %s after %d failures, want %s", wait, failures, want)
+		}
+	}
+	if wait := limiter.wait("user:alice"); wait != 0 {
+		t.Fatalf("wait %s for another key", wait)
+	}
+}
+
+// The username and the IP are locked out by LOGINMAXFAILURES failures in a
+// row, and the lockouts are audited
+func TestLoginLockout(t *testing.T) {
+	testDB(t)
+	defer loginSucceeded("mallory", "192.0.2.1")
+	for failures := 0; failures < LOGINMAXFAILURES; failures++ {
+		loginFailed("mallory", "192.0.2.1")
+	}
+	if wait := loginWait("mallory", "198.51.100.1"); !near(wait, LOCKOUTTIME) {
+		t.Fatalf("user waits %s, want %s", wait, LOCKOUTTIME)
+	}
+	if wait := loginWait("eve", "192.0.2.1"); !near(wait, LOCKOUTTIME) {
+		t.Fatalf("IP waits %s, want %s", wait, LOCKOUTTIME)
+	}
+	var count int
+	appDB.Model(&lockoutStruct{}).Count(&count)
+	if count != 2 {
+		t.Fatalf("%d lockouts audited, want 2", count)
+	}
+}
+
+// A successful login forgets the failures of the username and the IP
+func TestLoginSuccessResets(t *testing.T) {
+	loginFailed("trent", "203.0.113.1")
+	loginFailed("trent", "203.0.113.1")
+	if wait := loginWait("trent", "203.0.113.1"); wait == 0 {
+		t.Fatal("no wait after two failures")
+	}
+	loginSucceeded("trent", "203.0.113.1")
+	if wait := loginWait("trent", "203.0.113.1"); wait != 0 {
+		t.Fatalf("wait %s after a success", wait)
+	}
+	loginFailed("trent", "203.0.113.1")
+	if wait := loginWait("trent", "203.0.113.1"); !near(wait, LOGINBACKOFF) {
+		t.Fatalf("wait %s after a success and a failure, want %s", wait, LOGINBACKOFF)
+	}
+	loginSucceeded("trent", "203.0.113.1")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+)
+
+// session is a logged in device of a user. Events are pushed to its
+// subscription connection, which is the command connection if multiplexed.
+type session struct {
+	userID   uint64
+	token    string // Hash of the session token, "" if unknown
+	commands *protocol.Conn
+	events   *protocol.Conn // nil until subscribed
+	outbox   *outbox        // Queue of the events, nil until subscribed
+}
+
+func (obj *session) owns(conn *protocol.Conn) bool {
+	return obj.commands == conn || obj.events == conn
+}
+
+func (obj *session) close() {
+	if obj.outbox != nil {
+		obj.outbox.close()
+	}
+	if obj.commands != nil {
+		obj.commands.Close()
+	}
+	if obj.events != nil {
+		obj.events.Close()
+	}
+}
+
+// sessionRegistry owns the sessions of the connected users. It is shared by
+// the goroutines of every connection, the sessions are only changed under
+// its lock and handed out as copies.
+type sessionRegistry struct {
+	sync.RWMutex
+	sessions map[uint64][]*session // [user_id] devices
+}
+
+var registry = sessionRegistry{sessions: make(map[uint64][]*session)}
+
+// add opens a session for the command connection of a signed in device
+func (obj *sessionRegistry) add(userID uint64, token string, commands *protocol.Conn) *session {
+	obj.Lock()
+	defer obj.Unlock()
+	device := &session{userID: userID, token: hashToken(token), commands: commands}
+	obj.sessions[userID] = append(obj.sessions[userID], device)
+	return device
+}
+
+// multiplex makes the command connection of the session receive the events.
+// Returns true if the user came online with it.
+func (obj *sessionRegistry) multiplex(device *session) bool {
+	obj.Lock()
+	defer obj.Unlock()
+	wasOnline := obj.isOnline(device.userID)
+	device.events = device.commands
+	device.outbox = newOutbox(device.events, true)
+	return !wasOnline
+}
+
+// subscribe attaches a subscription connection to the session with the same
+// token or, if it was authenticated with the password, to the first session
+// without one. Returns true if the user came online with it.
+func (obj *sessionRegistry) subscribe(userID uint64, token string, events *protocol.Conn) bool {
+	hash := ""
+	if token != "" {
+		hash = hashToken(token)
+	}
+	obj.Lock()
+	defer obj.Unlock()
+	wasOnline := obj.isOnline(userID)
+	for _, device := range obj.sessions[userID] {
+		if device.events == nil && (hash == "" || device.token == hash) {
+			device.events = events
+			device.outbox = newOutbox(events, false)
+			return !wasOnline
+		}
+	}
+	obj.sessions[userID] = append(obj.sessions[userID], &session{userID: userID, token: hash, events: events, outbox: newOutbox(events, false)})
+	return !wasOnline
+}
+
+// remove closes both connections of the session owning conn. Returns true if
+// the user went offline with it.
+func (obj *sessionRegistry) remove(userID uint64, conn *protocol.Conn) bool {
+	conn.Close()
+	obj.Lock()
+	defer obj.Unlock()
+	devices := obj.sessions[userID]
+	for i, device := range devices {
+		if !device.owns(conn) {
+			continue
+		}
+		wasOnline := obj.isOnline(userID)
+		device.close()
+		obj.sessions[userID] = append(devices[:i:i], devices[i+1:]...)
+		if len(obj.sessions[userID]) == 0 {
+			delete(obj.sessions, userID)
+		}
+		return wasOnline && !obj.isOnline(userID)
+	}
+	return false
+}
+
+// closeAll logs every device of the user out, the failed reads of their
+// connections remove the sessions
+func (obj *sessionRegistry) closeAll(userID uint64) {
+	obj.RLock()
+	defer obj.RUnlock()
+	for _, device := range obj.sessions[userID] {
+		device.close()
+	}
+}
+
+// closeOthers logs out every device of the user but the session owning conn,
+// which keeps working with the new token
+func (obj *sessionRegistry) closeOthers(userID uint64, conn *protocol.Conn, token string) {
+	obj.Lock()
+	defer obj.Unlock()
+	for _, device := range obj.sessions[userID] {
+		if device.owns(conn) {
+			device.token = hashToken(token)
+		} else {
+			device.close()
+		}
+	}
+}
+
+// online tells if any device of the user is subscribed
+func (obj *sessionRegistry) online(userID uint64) bool {
+	obj.RLock()
+	defer obj.RUnlock()
+	return obj.isOnline(userID)
+}
+
+// isOnline is online for the callers holding the lock
+func (obj *sessionRegistry) isOnline(userID uint64) bool {
+	for _, device := range obj.sessions[userID] {
+		if device.events != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed returns copies of the subscribed sessions of the user: only the
+// session of the connection only if it is not nil, and not the session of the
+// connection except
+func (obj *sessionRegistry) subscribed(userID uint64, only, except *protocol.Conn) []session {
+	obj.RLock()
+	defer obj.RUnlock()
+	var devices []session
+	for _, device := range obj.sessions[userID] {
+		if device.events == nil || (only != nil && !device.owns(only)) || (except != nil && device.owns(except)) {
+			continue
+		}
+		devices = append(devices, *device)
+	}
+	return devices
+}
+
+// maxOutboxDepth returns the longest queue of events of a connection
+func (obj *sessionRegistry) maxOutboxDepth() int {
+	obj.RLock()
+	defer obj.RUnlock()
+	max := 0
+	for _, devices := range obj.sessions {
+		for _, device := range devices {
+			if device.outbox != nil && device.outbox.depth() > max {
+				max = device.outbox.depth()
+			}
+		}
+	}
+	return max
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Alex1ch/AppChatty/protocol"
+)
+
+// testConn returns the server side of a connection whose client side reads
+// everything until it is closed
+func testConn() *protocol.Conn {
+	client, server := net.Pipe()
+	go func() {
+		io.Copy(ioutil.Discard, client)
+		client.Close()
+	}()
+	return protocol.NewConn(server)
+}
+
+// Devices of several users sign in, subscribe, get events and leave at the
+// same time. Run with -race.
+func TestRegistryConcurrentSessions(t *testing.T) {
+	const (
+		users   = 8
+		devices = 4
+		rounds  = 20
+	)
+	var wg sync.WaitGroup
+	for user := uint64(1); user <= users; user++ {
+		for device := 0; device < devices; device++ {
+			wg.Add(1)
+			go func(userID uint64, device int) {
+				defer wg.Done()
+				for round := 0; round < rounds; round++ {
+					token := strconv.Itoa(device) + "-" + strconv.Itoa(round)
+					commands, events := testConn(), testConn()
+					signedIn := registry.add(userID, token, commands)
+					if device%2 == 0 {
+						registry.subscribe(userID, token, events)
+					} else {
+						registry.multiplex(signedIn)
+					}
+					sendPacketToSubscriber(userID, protocol.OpMessage, []byte(token))
+					sendPacketToSessions(userID, nil, commands, protocol.OpMessage, []byte(token))
+					registry.remove(userID, commands)
+					events.Close()
+				}
+			}(user, device)
+		}
+	}
+
+	// Broadcasts to every user while the sessions come and go
+	done := make(chan struct{})
+	var broadcasts sync.WaitGroup
+	broadcasts.Add(1)
+	go func() {
+		defer broadcasts.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for user := uint64(1); user <= users; user++ {
+				sendPacketToSubscriber(user, protocol.OpCheckOnline, nil)
+				registry.online(user)
+			}
+			registry.maxOutboxDepth()
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	broadcasts.Wait()
+
+	for user := uint64(1); user <= users; user++ {
+		if registry.online(user) {
+			t.Errorf("user %d is online after all devices left", user)
+		}
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	if len(registry.sessions) != 0 {
+		t.Errorf("%d users have sessions after all devices left", len(registry.sessions))
+	}
+}
@@ -0,0 +1,220 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned when the response to a request doesn't arrive in time
+var ErrTimeout = errors.New("Server not responding")
+
+// result is the response to a request or the error which replaced it
+type result struct {
+	packet *Packet
+	err    error
+}
+
+// Dispatcher owns the reading side of a connection. It tags every request
+// with a fresh request ID and routes each response to the caller waiting for
+// it, so several goroutines can have requests in flight at the same time.
+type Dispatcher struct {
+	conn *Conn
+
+	mutex   sync.Mutex
+	nextID  uint32
+	waiting map[uint32]chan result
+	err     error
+
+	pushes chan<- *Packet
+	queue  []*Packet     // Pushes not taken from pushes yet
+	queued chan struct{} // Wakes deliver up
+	done   chan struct{}
+}
+
+// NewDispatcher starts reading conn in the background. Packets without a
+// request ID are sent to pushes, or dropped if it is nil. They are queued
+// without limit, so the reader never waits for the receiver of pushes and
+// the receiver can make requests while handling a push. The dispatcher
+// pings the server every PingInterval, answers its pings and fails the
+// connection if nothing arrives within IdleTimeout.
+func NewDispatcher(conn *Conn, pushes chan<- *Packet) *Dispatcher {
+	obj := &Dispatcher{
+		conn:    conn,
+		waiting: make(map[uint32]chan result),
+		pushes:  pushes,
+		queued:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go obj.run()
+	go obj.deliver()
+	go obj.heartbeat()
+	return obj
+}
+
+// Conn returns the connection of the dispatcher
+func (obj *Dispatcher) Conn() *Conn {
+	return obj.conn
+}
+
+// Done is closed when the connection fails
+func (obj *Dispatcher) Done() <-chan struct{} {
+	return obj.done
+}
+
+// Err returns the error which stopped the dispatcher
+func (obj *Dispatcher) Err() error {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	return obj.err
+}
+
+// Send writes a packet which doesn't expect a response
+func (obj *Dispatcher) Send(opCode OpCode, data []byte) error {
+	if obj == nil {
+		return ErrNoConnection
+	}
+	return obj.conn.SendPacket(opCode, data)
+}
+
+// Request writes a packet and waits for the response to it. A zero timeout
+// waits until the connection fails.
+func (obj *Dispatcher) Request(opCode OpCode, data []byte, timeout time.Duration) (*Packet, error) {
+	if obj == nil {
+		return nil, ErrNoConnection
+	}
+	response := make(chan result, 1)
+
+	obj.mutex.Lock()
+	if obj.err != nil {
+		obj.mutex.Unlock()
+		return nil, obj.err
+	}
+	obj.nextID++
+	if obj.nextID == 0 {
+		obj.nextID++
+	}
+	requestID := obj.nextID
+	obj.waiting[requestID] = response
+	obj.mutex.Unlock()
+
+	defer func() {
+		obj.mutex.Lock()
+		delete(obj.waiting, requestID)
+		obj.mutex.Unlock()
+	}()
+
+	err := obj.conn.SendRequest(requestID, opCode, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case result := <-response:
+		return result.packet, result.err
+	case <-obj.done:
+		return nil, obj.Err()
+	case <-expired:
+		return nil, ErrTimeout
+	}
+}
+
+func (obj *Dispatcher) run() {
+	for {
+		packet, err := obj.conn.ReadPacket(IdleTimeout)
+		if err == ErrMessageTooLarge {
+			// The request of a skipped response fails without waiting for its timeout
+			obj.respond(packet.RequestID, result{err: err})
+			continue
+		}
+		if err != nil {
+			obj.mutex.Lock()
+			obj.err = err
+			obj.mutex.Unlock()
+			close(obj.done)
+			return
+		}
+
+		if packet.RequestID != 0 {
+			obj.respond(packet.RequestID, result{packet: packet})
+			continue
+		}
+		switch packet.OpCode {
+		case OpPing:
+			obj.conn.Reply(packet, OpPong, nil)
+		case OpPong:
+		default:
+			if obj.pushes != nil {
+				obj.mutex.Lock()
+				obj.queue = append(obj.queue, packet)
+				obj.mutex.Unlock()
+				select {
+				case obj.queued <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// respond passes the result to the request waiting for it. Responses nobody
+// waits for anymore (timed out) are dropped.
+func (obj *Dispatcher) respond(requestID uint32, result result) {
+	obj.mutex.Lock()
+	response, ok := obj.waiting[requestID]
+	obj.mutex.Unlock()
+	if ok {
+		select {
+		case response <- result:
+		default:
+		}
+	}
+}
+
+// deliver hands the queued pushes over to pushes in the order they arrived,
+// the ones read before the connection failed too
+func (obj *Dispatcher) deliver() {
+	for {
+		obj.mutex.Lock()
+		var packet *Packet
+		if len(obj.queue) > 0 {
+			packet = obj.queue[0]
+			obj.queue[0] = nil
+			obj.queue = obj.queue[1:]
+		}
+		obj.mutex.Unlock()
+
+		if packet != nil {
+			obj.pushes <- packet
+			continue
+		}
+		select {
+		case <-obj.queued:
+		case <-obj.done:
+			select {
+			case <-obj.queued:
+			default:
+				return
+			}
+		}
+	}
+}
+
+func (obj *Dispatcher) heartbeat() {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			obj.conn.SendPacket(OpPing, nil)
+		case <-obj.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A receiver of pushes makes a request while many more pushes are waiting,
+// like the client resolving names after being offline
+func TestRequestWhilePushesWait(t *testing.T) {
+	const pushCount = 200
+	client, server := net.Pipe()
+	peer := NewConn(server)
+	defer peer.Close()
+
+	pushes := make(chan *Packet)
+	dispatcher := NewDispatcher(NewConn(client), pushes)
+	defer dispatcher.Conn().Close()
+
+	go func() {
+		for i := 0; i < pushCount; i++ {
+			if err := peer.Push(OpMessage, []byte{byte(i)}); err != nil {
+				return
+			}
+		}
+		for {
+			packet, err := peer.ReadPacket(0)
+			if err != nil {
+				return
+			}
+			if packet.RequestID != 0 {
+				peer.Reply(packet, StatusOK, packet.Data)
+			}
+		}
+	}()
+
+	for i := 0; i < pushCount; i++ {
+		packet := <-pushes
+		if packet.Data[0] != byte(i) {
+			t.Fatalf("push %d arrived as %d", i, packet.Data[0])
+		}
+		if i == 0 {
+			response, err := dispatcher.Request(OpUserID, []byte("name"), 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(response.Data) != "name" {
+				t.Fatalf("response %q", response.Data)
+			}
+		}
+	}
+}
+
+// A response bigger than MaxMessageSize fails its request right away and
+// the next request still gets its response
+func TestRequestFailsOnTooLargeResponse(t *testing.T) {
+	client, server := net.Pipe()
+	peer := NewConn(server)
+	defer peer.Close()
+
+	conn := NewConn(client)
+	conn.MaxMessageSize = 16
+	dispatcher := NewDispatcher(conn, nil)
+	defer conn.Close()
+
+	go func() {
+		for {
+			packet, err := peer.ReadPacket(0)
+			if err != nil {
+				return
+			}
+			if packet.RequestID != 0 {
+				peer.Reply(packet, StatusOK, packet.Data)
+			}
+		}
+	}()
+
+	start := time.Now()
+	_, err := dispatcher.Request(OpUserID, make([]byte, 17), 10*time.Second)
+	if err != ErrMessageTooLarge {
+		t.Fatalf("got %v instead of ErrMessageTooLarge", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("request failed after %s", elapsed)
+	}
+	response, err := dispatcher.Request(OpUserID, []byte("name"), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response.Data) != "name" {
+		t.Fatalf("response %q", response.Data)
+	}
+}
@@ -0,0 +1,1161 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTrailingData is returned by Unmarshal when the data is longer than the structure
+var ErrTrailingData = errors.New("Unexpected data at the end of packet")
+
+func finish(parser *Parser) error {
+	if parser.Remaining() != 0 {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// Message is the data of OpMessage. It is sent by the client to the command
+// connection and pushed by the server to the subscription connection.
+// Exactly one of UserID and GroupID is not 0.
+type Message struct {
+	SenderID uint64
+	UserID   uint64
+	GroupID  uint64
+	Text     string
+	// MessageID is assigned by the server, 0 in requests and in the replies
+	// to group commands. IDs grow with every stored message.
+	MessageID uint64
+	// Timestamp is the server time of the message in UTC milliseconds since
+	// the Unix epoch, 0 in requests
+	Timestamp uint64
+}
+
+// Time returns the server time of the message, zero if unknown
+func (obj *Message) Time() time.Time {
+	return TimeFromTimestamp(obj.Timestamp)
+}
+
+// Timestamp converts t to UTC milliseconds since the Unix epoch
+func Timestamp(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// TimeFromTimestamp converts UTC milliseconds since the Unix epoch to time,
+// 0 to the zero time
+func TimeFromTimestamp(timestamp uint64) time.Time {
+	if timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(timestamp)*int64(time.Millisecond)).UTC()
+}
+
+// Marshal serializes the message
+func (obj *Message) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	if err := obj.write(serial); err != nil {
+		return nil, err
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the message from data
+func (obj *Message) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	if err := obj.read(parser); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+func (obj *Message) write(serial *Serializer) error {
+	serial.UInt64(obj.SenderID)
+	serial.UInt64(obj.UserID)
+	serial.UInt64(obj.GroupID)
+	err := serial.String(obj.Text, 4)
+	if err != nil {
+		return err
+	}
+	serial.UInt64(obj.MessageID)
+	serial.UInt64(obj.Timestamp)
+	return nil
+}
+
+func (obj *Message) read(parser *Parser) error {
+	var err error
+	if obj.SenderID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.UserID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	msgLen, err := parser.UInt32()
+	if err != nil {
+		return err
+	}
+	if obj.Text, err = parser.String(int(msgLen)); err != nil {
+		return err
+	}
+	if obj.MessageID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	obj.Timestamp, err = parser.UInt64()
+	return err
+}
+
+// MessageResponse is the data of StatusOK and StatusAccepted in response to
+// OpMessage. The data is empty if the message was a group command.
+type MessageResponse struct {
+	MessageID uint64
+	Timestamp uint64
+}
+
+// Marshal serializes the response
+func (obj *MessageResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.MessageID)
+	serial.UInt64(obj.Timestamp)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *MessageResponse) Unmarshal(data []byte) error {
+	var err error
+	obj.MessageID, obj.Timestamp = 0, 0
+	if len(data) == 0 {
+		return nil
+	}
+	parser := NewParser(data)
+	if obj.MessageID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.Timestamp, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// AckRequest is the data of OpAck
+type AckRequest struct {
+	// State is ReceiptDelivered or ReceiptRead
+	State      byte
+	MessageIDs []uint64
+}
+
+// Marshal serializes the request
+func (obj *AckRequest) Marshal() ([]byte, error) {
+	if len(obj.MessageIDs) > 65535 {
+		return nil, errors.New("Too many messages")
+	}
+	serial := NewSerializer()
+	serial.Byte(obj.State)
+	serial.UInt16(uint16(len(obj.MessageIDs)))
+	for _, id := range obj.MessageIDs {
+		serial.UInt64(id)
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *AckRequest) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.State, err = parser.Byte(); err != nil {
+		return err
+	}
+	idCount, err := parser.UInt16()
+	if err != nil {
+		return err
+	}
+	obj.MessageIDs = make([]uint64, idCount)
+	for i := range obj.MessageIDs {
+		if obj.MessageIDs[i], err = parser.UInt64(); err != nil {
+			return err
+		}
+	}
+	return finish(parser)
+}
+
+// Receipt is the data of OpReceipt
+type Receipt struct {
+	MessageID uint64
+	// UserID is the recipient whose client acknowledged the message
+	UserID uint64
+	State  byte
+}
+
+// Marshal serializes the receipt
+func (obj *Receipt) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.MessageID)
+	serial.UInt64(obj.UserID)
+	serial.Byte(obj.State)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the receipt from data
+func (obj *Receipt) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.MessageID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.UserID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.State, err = parser.Byte(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// HistoryRequest is the data of OpHistory. Exactly one of UserID and GroupID
+// is not 0.
+type HistoryRequest struct {
+	UserID  uint64
+	GroupID uint64
+	// BeforeID limits the page to messages older than this one, 0 for the newest messages
+	BeforeID uint64
+	// Limit is the maximum count of messages in the page
+	Limit uint16
+}
+
+// Marshal serializes the request
+func (obj *HistoryRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.UserID)
+	serial.UInt64(obj.GroupID)
+	serial.UInt64(obj.BeforeID)
+	serial.UInt16(obj.Limit)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *HistoryRequest) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.UserID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.BeforeID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.Limit, err = parser.UInt16(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// HistoryEntry is a stored message with its delivery state. State is the best
+// state reached by the recipients for the messages of the requesting user and
+// the acknowledged state for the others.
+type HistoryEntry struct {
+	Message
+	State byte
+}
+
+// HistoryResponse is the data of StatusOK in response to OpHistory. Messages
+// are ordered from the oldest to the newest.
+type HistoryResponse struct {
+	Messages []HistoryEntry
+}
+
+// Marshal serializes the response
+func (obj *HistoryResponse) Marshal() ([]byte, error) {
+	if len(obj.Messages) > 65535 {
+		return nil, errors.New("Too many messages")
+	}
+	serial := NewSerializer()
+	serial.UInt16(uint16(len(obj.Messages)))
+	for i := range obj.Messages {
+		if err := obj.Messages[i].write(serial); err != nil {
+			return nil, err
+		}
+		serial.Byte(obj.Messages[i].State)
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *HistoryResponse) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	count, err := parser.UInt16()
+	if err != nil {
+		return err
+	}
+	obj.Messages = make([]HistoryEntry, count)
+	for i := range obj.Messages {
+		if err = obj.Messages[i].read(parser); err != nil {
+			return err
+		}
+		if obj.Messages[i].State, err = parser.Byte(); err != nil {
+			return err
+		}
+	}
+	return finish(parser)
+}
+
+// CreateGroupRequest is the data of OpCreateGroup
+type CreateGroupRequest struct {
+	Name string
+	// Public groups can be found with OpSearchGroups and joined by anyone.
+	// It is an optional trailing byte.
+	Public bool
+}
+
+// Marshal serializes the request
+func (obj *CreateGroupRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	err := serial.String(obj.Name, 1)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Public {
+		serial.Byte(1)
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *CreateGroupRequest) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	nLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Name, err = parser.String(int(nLen)); err != nil {
+		return err
+	}
+	obj.Public = false
+	if parser.Remaining() != 0 {
+		public, err := parser.Byte()
+		if err != nil {
+			return err
+		}
+		obj.Public = public == 1
+	}
+	return finish(parser)
+}
+
+// CreateGroupResponse is the data of StatusOK in response to OpCreateGroup
+type CreateGroupResponse struct {
+	GroupID uint64
+}
+
+// Marshal serializes the response
+func (obj *CreateGroupResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.GroupID)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *CreateGroupResponse) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// GroupNameRequest is the data of OpGroupName
+type GroupNameRequest struct {
+	GroupID uint64
+}
+
+// Marshal serializes the request
+func (obj *GroupNameRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.GroupID)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *GroupNameRequest) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// NameResponse is the data of StatusOK in response to OpGroupName and OpUsername
+type NameResponse struct {
+	Name string
+}
+
+// Marshal serializes the response
+func (obj *NameResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	err := serial.String(obj.Name, 1)
+	if err != nil {
+		return nil, err
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *NameResponse) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	nLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Name, err = parser.String(int(nLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// Credential options
+const (
+	// OptionMultiplex asks the server to push the events on the same
+	// connection instead of a separate subscription connection
+	OptionMultiplex byte = 1
+	// OptionToken tells that the password field carries a session token
+	// returned by OpRegister or OpAuth. Used by OpAuth and OpSubscribe.
+	OptionToken byte = 2
+)
+
+// Credentials is the data of OpRegister, OpAuth and OpSubscribe
+type Credentials struct {
+	Username string
+	// Password is the session token with OptionToken
+	Password string
+	// Options is an optional trailing byte of Option flags
+	Options byte
+}
+
+// Marshal serializes the credentials
+func (obj *Credentials) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	if err := serial.String(obj.Username, 1); err != nil {
+		return nil, errors.New("Username is too big")
+	}
+	if err := serial.String(obj.Password, 1); err != nil {
+		return nil, errors.New("Password is too big")
+	}
+	if obj.Options != 0 {
+		serial.Byte(obj.Options)
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the credentials from data
+func (obj *Credentials) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	nLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Username, err = parser.String(int(nLen)); err != nil {
+		return err
+	}
+	passLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Password, err = parser.String(int(passLen)); err != nil {
+		return err
+	}
+	obj.Options = 0
+	if parser.Remaining() != 0 {
+		if obj.Options, err = parser.Byte(); err != nil {
+			return err
+		}
+	}
+	return finish(parser)
+}
+
+// AuthResponse is the data of StatusOK in response to OpRegister and OpAuth
+type AuthResponse struct {
+	UserID uint64
+	// Token replaces the password in OpSubscribe and in later OpAuth until it
+	// expires or is revoked with OpLogout
+	Token string
+}
+
+// Marshal serializes the response
+func (obj *AuthResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.UserID)
+	if err := serial.String(obj.Token, 1); err != nil {
+		return nil, errors.New("Token is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *AuthResponse) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.UserID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	tokenLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Token, err = parser.String(int(tokenLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// ErrorResponse is the optional data of an error response telling the reason
+type ErrorResponse struct {
+	Reason string
+}
+
+// Marshal serializes the response
+func (obj *ErrorResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	if err := serial.String(obj.Reason, 1); err != nil {
+		return nil, errors.New("Reason is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *ErrorResponse) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	reasonLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Reason, err = parser.String(int(reasonLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// RetryResponse is the data of StatusTooManyRequests
+type RetryResponse struct {
+	// Seconds to wait before the next login attempt
+	Seconds uint32
+}
+
+// Marshal serializes the response
+func (obj *RetryResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt32(obj.Seconds)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *RetryResponse) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.Seconds, err = parser.UInt32(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// LogoutRequest is the data of OpLogout
+type LogoutRequest struct {
+	Token string
+}
+
+// Marshal serializes the request
+func (obj *LogoutRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	if err := serial.String(obj.Token, 1); err != nil {
+		return nil, errors.New("Token is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *LogoutRequest) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	tokenLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Token, err = parser.String(int(tokenLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// ChangePasswordRequest is the data of OpChangePassword. The response to it
+// is AuthResponse with a new token, the other tokens of the user are revoked.
+type ChangePasswordRequest struct {
+	OldPassword string
+	NewPassword string
+}
+
+// Marshal serializes the request
+func (obj *ChangePasswordRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	if err := serial.String(obj.OldPassword, 1); err != nil {
+		return nil, errors.New("Password is too big")
+	}
+	if err := serial.String(obj.NewPassword, 1); err != nil {
+		return nil, errors.New("Password is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *ChangePasswordRequest) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	oldLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.OldPassword, err = parser.String(int(oldLen)); err != nil {
+		return err
+	}
+	newLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.NewPassword, err = parser.String(int(newLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// DeleteAccountRequest is the data of OpDeleteAccount
+type DeleteAccountRequest struct {
+	Password string
+}
+
+// Marshal serializes the request
+func (obj *DeleteAccountRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	if err := serial.String(obj.Password, 1); err != nil {
+		return nil, errors.New("Password is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *DeleteAccountRequest) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	passLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Password, err = parser.String(int(passLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// GroupCommandRequest is the data of OpGroupCommand
+type GroupCommandRequest struct {
+	GroupID uint64
+	// Command is the name of the command without the slash, e.g. "add"
+	Command string
+	Args    []string
+}
+
+// Marshal serializes the request
+func (obj *GroupCommandRequest) Marshal() ([]byte, error) {
+	if len(obj.Args) > 255 {
+		return nil, errors.New("Too many arguments")
+	}
+	serial := NewSerializer()
+	serial.UInt64(obj.GroupID)
+	if err := serial.String(obj.Command, 1); err != nil {
+		return nil, errors.New("Command is too big")
+	}
+	serial.Byte(byte(len(obj.Args)))
+	for _, arg := range obj.Args {
+		if err := serial.String(arg, 2); err != nil {
+			return nil, errors.New("Argument is too big")
+		}
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *GroupCommandRequest) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	commandLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Command, err = parser.String(int(commandLen)); err != nil {
+		return err
+	}
+	argCount, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	obj.Args = make([]string, argCount)
+	for i := range obj.Args {
+		argLen, err := parser.UInt16()
+		if err != nil {
+			return err
+		}
+		if obj.Args[i], err = parser.String(int(argLen)); err != nil {
+			return err
+		}
+	}
+	return finish(parser)
+}
+
+// GroupCommandResponse is the data of the response to OpGroupCommand, the
+// text the System shows to the caller
+type GroupCommandResponse struct {
+	Text string
+}
+
+// Marshal serializes the response
+func (obj *GroupCommandResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	// The lists of big groups are longer than 64 KiB
+	if err := serial.String(obj.Text, 4); err != nil {
+		return nil, errors.New("Text is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *GroupCommandResponse) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	textLen, err := parser.UInt32()
+	if err != nil {
+		return err
+	}
+	if obj.Text, err = parser.String(int(textLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// Invite is the data of OpInvite, an invitation to a group waiting for the
+// answer of the user
+type Invite struct {
+	InviteID  uint64
+	GroupID   uint64
+	GroupName string
+	Inviter   string
+	// ExpiresAt is the end of the invitation in UTC milliseconds since the Unix epoch
+	ExpiresAt uint64
+}
+
+// Marshal serializes the invitation
+func (obj *Invite) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.InviteID)
+	serial.UInt64(obj.GroupID)
+	if err := serial.String(obj.GroupName, 1); err != nil {
+		return nil, errors.New("Group name is too big")
+	}
+	if err := serial.String(obj.Inviter, 1); err != nil {
+		return nil, errors.New("Username is too big")
+	}
+	serial.UInt64(obj.ExpiresAt)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the invitation from data
+func (obj *Invite) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.InviteID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	nameLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.GroupName, err = parser.String(int(nameLen)); err != nil {
+		return err
+	}
+	inviterLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Inviter, err = parser.String(int(inviterLen)); err != nil {
+		return err
+	}
+	if obj.ExpiresAt, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// InviteRequest is the data of OpAcceptInvite and OpDeclineInvite
+type InviteRequest struct {
+	InviteID uint64
+}
+
+// Marshal serializes the request
+func (obj *InviteRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.InviteID)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *InviteRequest) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.InviteID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// JoinResponse is the data of StatusOK in response to OpAcceptInvite and
+// OpJoinGroup, the group the user joined
+type JoinResponse struct {
+	GroupID uint64
+}
+
+// Marshal serializes the response
+func (obj *JoinResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.GroupID)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *JoinResponse) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// SearchGroupsRequest is the data of OpSearchGroups
+type SearchGroupsRequest struct {
+	// Query is a part of the name, "" lists the biggest groups
+	Query string
+}
+
+// Marshal serializes the request
+func (obj *SearchGroupsRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	if err := serial.String(obj.Query, 1); err != nil {
+		return nil, errors.New("Query is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *SearchGroupsRequest) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	queryLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Query, err = parser.String(int(queryLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// GroupInfo describes a public group found by OpSearchGroups
+type GroupInfo struct {
+	GroupID uint64
+	Name    string
+	Members uint32
+}
+
+// SearchGroupsResponse is the data of StatusOK in response to OpSearchGroups
+type SearchGroupsResponse struct {
+	Groups []GroupInfo
+}
+
+// Marshal serializes the response
+func (obj *SearchGroupsResponse) Marshal() ([]byte, error) {
+	if len(obj.Groups) > 65535 {
+		return nil, errors.New("Too many groups")
+	}
+	serial := NewSerializer()
+	serial.UInt16(uint16(len(obj.Groups)))
+	for _, group := range obj.Groups {
+		serial.UInt64(group.GroupID)
+		if err := serial.String(group.Name, 1); err != nil {
+			return nil, errors.New("Group name is too big")
+		}
+		serial.UInt32(group.Members)
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *SearchGroupsResponse) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	groupCount, err := parser.UInt16()
+	if err != nil {
+		return err
+	}
+	obj.Groups = make([]GroupInfo, groupCount)
+	for i := range obj.Groups {
+		group := &obj.Groups[i]
+		if group.GroupID, err = parser.UInt64(); err != nil {
+			return err
+		}
+		nameLen, err := parser.Byte()
+		if err != nil {
+			return err
+		}
+		if group.Name, err = parser.String(int(nameLen)); err != nil {
+			return err
+		}
+		if group.Members, err = parser.UInt32(); err != nil {
+			return err
+		}
+	}
+	return finish(parser)
+}
+
+// JoinGroupRequest is the data of OpJoinGroup
+type JoinGroupRequest struct {
+	GroupID uint64
+}
+
+// Marshal serializes the request
+func (obj *JoinGroupRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.GroupID)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *JoinGroupRequest) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// GroupChanged is pushed to the members of a group when it is renamed, gets
+// a new topic or is deleted, and for every group on subscription
+type GroupChanged struct {
+	GroupID uint64
+	Name    string
+	Topic   string // "" if not set
+	Deleted bool
+}
+
+// Marshal serializes the push
+func (obj *GroupChanged) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.GroupID)
+	if err := serial.String(obj.Name, 1); err != nil {
+		return nil, errors.New("Group name is too big")
+	}
+	if err := serial.String(obj.Topic, 2); err != nil {
+		return nil, errors.New("Topic is too big")
+	}
+	if obj.Deleted {
+		serial.Byte(1)
+	} else {
+		serial.Byte(0)
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the push from data
+func (obj *GroupChanged) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.GroupID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	nameLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Name, err = parser.String(int(nameLen)); err != nil {
+		return err
+	}
+	topicLen, err := parser.UInt16()
+	if err != nil {
+		return err
+	}
+	if obj.Topic, err = parser.String(int(topicLen)); err != nil {
+		return err
+	}
+	deleted, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	obj.Deleted = deleted == 1
+	return finish(parser)
+}
+
+// UserIDRequest is the data of OpUserID
+type UserIDRequest struct {
+	Username string
+}
+
+// Marshal serializes the request
+func (obj *UserIDRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	err := serial.String(obj.Username, 1)
+	if err != nil {
+		return nil, errors.New("Name is too big")
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *UserIDRequest) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	nLen, err := parser.Byte()
+	if err != nil {
+		return err
+	}
+	if obj.Username, err = parser.String(int(nLen)); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// UserIDResponse is the data of StatusOK in response to OpUserID
+type UserIDResponse struct {
+	UserID uint64
+}
+
+// Marshal serializes the response
+func (obj *UserIDResponse) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.UserID)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *UserIDResponse) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.UserID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// UsernameRequest is the data of OpUsername
+type UsernameRequest struct {
+	UserID uint64
+}
+
+// Marshal serializes the request
+func (obj *UsernameRequest) Marshal() ([]byte, error) {
+	serial := NewSerializer()
+	serial.UInt64(obj.UserID)
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *UsernameRequest) Unmarshal(data []byte) error {
+	var err error
+	parser := NewParser(data)
+	if obj.UserID, err = parser.UInt64(); err != nil {
+		return err
+	}
+	return finish(parser)
+}
+
+// CheckOnlineRequest is the data of OpCheckOnline sent by the client
+type CheckOnlineRequest struct {
+	UserIDs []uint64
+}
+
+// Marshal serializes the request
+func (obj *CheckOnlineRequest) Marshal() ([]byte, error) {
+	if len(obj.UserIDs) > 65535 {
+		return nil, errors.New("Too many users")
+	}
+	serial := NewSerializer()
+	serial.UInt16(uint16(len(obj.UserIDs)))
+	for _, id := range obj.UserIDs {
+		serial.UInt64(id)
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the request from data
+func (obj *CheckOnlineRequest) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	idCount, err := parser.UInt16()
+	if err != nil {
+		return err
+	}
+	obj.UserIDs = make([]uint64, idCount)
+	for i := range obj.UserIDs {
+		if obj.UserIDs[i], err = parser.UInt64(); err != nil {
+			return err
+		}
+	}
+	return finish(parser)
+}
+
+// OnlineStatus is the online state of a single user
+type OnlineStatus struct {
+	UserID uint64
+	Online bool
+}
+
+// CheckOnlineResponse is the data of OpCheckOnline pushed by the server to
+// the subscription connection
+type CheckOnlineResponse struct {
+	Users []OnlineStatus
+}
+
+// Marshal serializes the response
+func (obj *CheckOnlineResponse) Marshal() ([]byte, error) {
+	if len(obj.Users) > 65535 {
+		return nil, errors.New("Too many users")
+	}
+	serial := NewSerializer()
+	serial.UInt16(uint16(len(obj.Users)))
+	for _, user := range obj.Users {
+		serial.UInt64(user.UserID)
+		if user.Online {
+			serial.Byte(1)
+		} else {
+			serial.Byte(0)
+		}
+	}
+	return serial.Bytes(), nil
+}
+
+// Unmarshal parses the response from data
+func (obj *CheckOnlineResponse) Unmarshal(data []byte) error {
+	parser := NewParser(data)
+	idCount, err := parser.UInt16()
+	if err != nil {
+		return err
+	}
+	obj.Users = make([]OnlineStatus, idCount)
+	for i := range obj.Users {
+		if obj.Users[i].UserID, err = parser.UInt64(); err != nil {
+			return err
+		}
+		online, err := parser.Byte()
+		if err != nil {
+			return err
+		}
+		obj.Users[i].Online = online == 1
+	}
+	return finish(parser)
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+// The member list of a big group doesn't fit into 64 KiB
+func TestGroupCommandResponseLongText(t *testing.T) {
+	response := GroupCommandResponse{Text: strings.Repeat("1. 🔵 member\n", 10000)}
+	data, err := response.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed GroupCommandResponse
+	if err := parsed.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Text != response.Text {
+		t.Fatalf("%d bytes of text parsed as %d", len(response.Text), len(parsed.Text))
+	}
+}
@@ -0,0 +1,247 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxDataLen is the biggest data a single frame can carry, bigger packets
+	// are split into fragments
+	MaxDataLen = 65535
+	// DefaultMaxMessageSize is the biggest reassembled packet accepted by default
+	DefaultMaxMessageSize = 16 << 20
+	// DefaultFrameTimeout is the time given to the rest of a packet to arrive
+	// once its first header was received
+	DefaultFrameTimeout = 30 * time.Second
+	// PingInterval is how often both sides send OpPing on a signed in connection
+	PingInterval = 30 * time.Second
+	// IdleTimeout is the silence after which the peer is considered dead,
+	// it missed three pings
+	IdleTimeout = 3 * PingInterval
+
+	headerLen = 4
+)
+
+var (
+	// ErrNoConnection is returned when a packet is read from or sent to a nil connection
+	ErrNoConnection = errors.New("No connection available")
+	// ErrShortRead is returned when the connection ends in the middle of a packet
+	ErrShortRead = errors.New("Connection closed in the middle of a packet")
+	// ErrFrameTooLarge is returned when the header announces more data than allowed
+	ErrFrameTooLarge = errors.New("Packet is bigger than allowed")
+	// ErrMessageTooLarge is returned when the fragments of a packet add up to
+	// more than MaxMessageSize. The fragments are skipped, so the connection
+	// stays usable and the packet is returned without data.
+	ErrMessageTooLarge = errors.New("Message is bigger than allowed")
+	// ErrBadFragment is returned when a fragment has another opcode than the
+	// packet it continues
+	ErrBadFragment = errors.New("Fragment doesn't match the packet")
+)
+
+// Packet is a single packet received from the connection, reassembled from
+// its fragments if it was split
+type Packet struct {
+	OpCode OpCode
+	// RequestID is 0 if the packet doesn't belong to a request
+	RequestID uint32
+	// Push is set for events pushed on a multiplexed connection
+	Push bool
+	Data []byte
+}
+
+// Conn is a connection which reads whole packets through a buffered reader.
+// Packets can be sent from several goroutines, their frames are never
+// interleaved.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+
+	// MaxFrameSize is the biggest data accepted in a single frame, bigger
+	// frames are rejected before anything is allocated for them
+	MaxFrameSize int
+	// MaxMessageSize is the biggest packet accepted after reassembly of fragments
+	MaxMessageSize int
+	// FrameTimeout limits the time between the first header and the end of the packet
+	FrameTimeout time.Duration
+}
+
+// NewConn wraps conn into a Conn with default limits
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:           conn,
+		reader:         bufio.NewReader(conn),
+		MaxFrameSize:   MaxDataLen,
+		MaxMessageSize: DefaultMaxMessageSize,
+		FrameTimeout:   DefaultFrameTimeout,
+	}
+}
+
+// ReadPacket reads the next packet. A zero timeout waits forever for the
+// first header, the rest of the packet has to arrive within FrameTimeout.
+// The connection is closed if the packet can't be read.
+func (c *Conn) ReadPacket(timeout time.Duration) (*Packet, error) {
+	if c == nil {
+		return nil, ErrNoConnection
+	}
+	if timeout != 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.SetReadDeadline(time.Time{})
+	}
+
+	var packet *Packet
+	tooLarge := false
+	for {
+		opCode, data, err := c.readFrame(packet == nil)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		more := opCode&FlagMore != 0
+
+		if packet == nil {
+			packet = &Packet{OpCode: opCode &^ flagsMask, Push: opCode&FlagPush != 0}
+			if opCode&FlagRequest != 0 {
+				parser := NewParser(data)
+				packet.RequestID, err = parser.UInt32()
+				if err != nil {
+					c.Close()
+					return nil, err
+				}
+				data = data[4:]
+			}
+		} else if opCode&^flagsMask != packet.OpCode {
+			c.Close()
+			return nil, ErrBadFragment
+		}
+		if !tooLarge {
+			if len(packet.Data)+len(data) > c.MaxMessageSize {
+				tooLarge = true
+				packet.Data = nil
+			} else {
+				packet.Data = append(packet.Data, data...)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	if tooLarge {
+		return packet, ErrMessageTooLarge
+	}
+	return packet, nil
+}
+
+// readFrame reads a single frame, the deadline of the first header is set
+// by the caller
+func (c *Conn) readFrame(first bool) (OpCode, []byte, error) {
+	if !first && c.FrameTimeout != 0 {
+		c.SetReadDeadline(time.Now().Add(c.FrameTimeout))
+	}
+	header := make([]byte, headerLen)
+	_, err := io.ReadFull(c.reader, header)
+	if err == io.EOF && !first {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, shortRead(err)
+	}
+	dataLen := int(binary.LittleEndian.Uint16(header[:2]))
+	opCode := OpCode(binary.LittleEndian.Uint16(header[2:]))
+	if dataLen == 0 {
+		return opCode, nil, nil
+	}
+	if dataLen > c.MaxFrameSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+
+	if c.FrameTimeout != 0 {
+		c.SetReadDeadline(time.Now().Add(c.FrameTimeout))
+	}
+	data := make([]byte, dataLen)
+	_, err = io.ReadFull(c.reader, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, shortRead(err)
+	}
+	return opCode, data, nil
+}
+
+// SendPacket writes a packet, data can be nil. Data bigger than MaxDataLen
+// is split into fragments which are written at once, so they are never
+// interleaved with other packets.
+func (c *Conn) SendPacket(opCode OpCode, data []byte) error {
+	return c.SendRequest(0, opCode, data)
+}
+
+// SendRequest writes a packet tagged with requestID, 0 means no request ID
+func (c *Conn) SendRequest(requestID uint32, opCode OpCode, data []byte) error {
+	return c.send(0, requestID, opCode, data)
+}
+
+// Push writes an event marked with FlagPush
+func (c *Conn) Push(opCode OpCode, data []byte) error {
+	return c.send(FlagPush, 0, opCode, data)
+}
+
+func (c *Conn) send(flags OpCode, requestID uint32, opCode OpCode, data []byte) error {
+	if c == nil {
+		return ErrNoConnection
+	}
+	if opCode&flagsMask != 0 {
+		return errors.New("Opcode overlaps with the frame flags")
+	}
+	opCode |= flags
+	if requestID != 0 {
+		serial := NewSerializer()
+		serial.UInt32(requestID)
+		serial.buffer.Write(data)
+		data = serial.Bytes()
+		opCode |= FlagRequest
+	}
+	buffer := make([]byte, 0, len(data)+headerLen*(len(data)/MaxDataLen+1))
+	for {
+		chunk := data
+		more := OpCode(0)
+		if len(chunk) > MaxDataLen {
+			chunk = data[:MaxDataLen]
+			more = FlagMore
+		}
+		header := make([]byte, headerLen)
+		binary.LittleEndian.PutUint16(header[:2], uint16(len(chunk)))
+		binary.LittleEndian.PutUint16(header[2:], uint16(opCode|more))
+		buffer = append(buffer, header...)
+		buffer = append(buffer, chunk...)
+		data = data[len(chunk):]
+		if more == 0 {
+			break
+		}
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Write(buffer)
+	return err
+}
+
+// Reply writes the response to request, echoing its request ID
+func (c *Conn) Reply(request *Packet, opCode OpCode, data []byte) error {
+	return c.SendRequest(request.RequestID, opCode, data)
+}
+
+// shortRead reports a packet cut in the middle as ErrShortRead, a clean end
+// of the connection between packets stays io.EOF
+func shortRead(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return ErrShortRead
+	}
+	return err
+}
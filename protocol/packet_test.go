@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Packets sent from several goroutines arrive whole, with their fragments in
+// a row, even if they are split into several frames
+func TestConcurrentSendsDoNotInterleave(t *testing.T) {
+	const (
+		writers = 8
+		packets = 50
+	)
+	client, server := net.Pipe()
+	sender, receiver := NewConn(client), NewConn(server)
+	defer sender.Close()
+	defer receiver.Close()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= writers; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			// Two full fragments and a short one
+			data := bytes.Repeat([]byte{byte(writer)}, 2*MaxDataLen+writer)
+			for j := 0; j < packets; j++ {
+				var err error
+				switch j % 3 {
+				case 0:
+					err = sender.SendPacket(OpCode(writer), data)
+				case 1:
+					err = sender.SendRequest(uint32(writer), OpCode(writer), data)
+				default:
+					err = sender.Push(OpCode(writer), data)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	for n := 0; n < writers*packets; n++ {
+		packet, err := receiver.ReadPacket(0)
+		if err != nil {
+			t.Fatalf("packet %d: %v", n, err)
+		}
+		writer := int(packet.OpCode)
+		if writer < 1 || writer > writers {
+			t.Fatalf("packet %d: unexpected opcode %d", n, packet.OpCode)
+		}
+		if packet.RequestID != 0 && packet.RequestID != uint32(writer) {
+			t.Fatalf("packet %d: request ID %d of writer %d", n, packet.RequestID, writer)
+		}
+		if len(packet.Data) != 2*MaxDataLen+writer {
+			t.Fatalf("packet %d: %d bytes from writer %d", n, len(packet.Data), writer)
+		}
+		if !bytes.Equal(packet.Data, bytes.Repeat([]byte{byte(writer)}, len(packet.Data))) {
+			t.Fatalf("packet %d: data of writer %d is mixed with another packet", n, writer)
+		}
+	}
+	wg.Wait()
+}
+
+// writeFrames writes raw frames to conn and closes it
+func writeFrames(conn net.Conn, frames ...[]byte) {
+	for _, frame := range frames {
+		if _, err := conn.Write(frame); err != nil {
+			break
+		}
+	}
+	conn.Close()
+}
+
+// header returns the header of a frame with dataLen bytes of data
+func header(dataLen int, opCode OpCode) []byte {
+	frame := make([]byte, headerLen)
+	binary.LittleEndian.PutUint16(frame[:2], uint16(dataLen))
+	binary.LittleEndian.PutUint16(frame[2:], uint16(opCode))
+	return frame
+}
+
+// The connection ends in the middle of the data of a frame or before the
+// next fragment of a packet
+func TestShortRead(t *testing.T) {
+	cases := map[string][][]byte{
+		"data":     {header(10, OpMessage), []byte("abc")},
+		"fragment": {header(3, OpMessage|FlagMore), []byte("abc")},
+		"header":   {header(3, OpMessage|FlagMore), []byte("abc"), []byte{1}},
+	}
+	for name, frames := range cases {
+		client, server := net.Pipe()
+		go writeFrames(client, frames...)
+		packet, err := NewConn(server).ReadPacket(0)
+		if err != ErrShortRead {
+			t.Errorf("%s: got %v, %v instead of ErrShortRead", name, packet, err)
+		}
+	}
+}
+
+// A frame bigger than MaxFrameSize is rejected and closes the connection
+func TestFrameTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	go writeFrames(client, header(17, OpMessage), make([]byte, 17))
+	receiver := NewConn(server)
+	receiver.MaxFrameSize = 16
+	packet, err := receiver.ReadPacket(0)
+	if err != ErrFrameTooLarge {
+		t.Fatalf("got %v, %v instead of ErrFrameTooLarge", packet, err)
+	}
+	if _, err = receiver.ReadPacket(0); err == nil {
+		t.Fatal("connection is still open")
+	}
+}
+
+// Fragments adding up to more than MaxMessageSize are skipped, the request ID
+// is kept for the reply and the next packet is read as usual
+func TestMessageTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	sender, receiver := NewConn(client), NewConn(server)
+	defer sender.Close()
+	defer receiver.Close()
+	receiver.MaxMessageSize = MaxDataLen
+
+	go func() {
+		if err := sender.SendRequest(7, OpMessage, make([]byte, 2*MaxDataLen)); err != nil {
+			return
+		}
+		sender.SendPacket(OpPing, []byte("next"))
+	}()
+
+	packet, err := receiver.ReadPacket(0)
+	if err != ErrMessageTooLarge {
+		t.Fatalf("got %v instead of ErrMessageTooLarge", err)
+	}
+	if packet == nil || packet.RequestID != 7 || packet.OpCode != OpMessage || packet.Data != nil {
+		t.Fatalf("packet %+v", packet)
+	}
+	packet, err = receiver.ReadPacket(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.OpCode != OpPing || string(packet.Data) != "next" {
+		t.Fatalf("next packet %+v", packet)
+	}
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrOutOfRange is returned by the Parser when a field doesn't fit in the data
+var ErrOutOfRange = errors.New("Offset is out of range")
+
+// Parser reads fields from the data of a packet one after another
+type Parser struct {
+	data   []byte
+	offset int
+}
+
+// NewParser returns a Parser positioned at the beginning of data
+func NewParser(data []byte) *Parser {
+	return &Parser{data, 0}
+}
+
+// Remaining returns the number of bytes which were not read yet
+func (obj *Parser) Remaining() int {
+	return len(obj.data) - obj.offset
+}
+
+func (obj *Parser) next(count int) ([]byte, error) {
+	if count < 0 || obj.offset+count > len(obj.data) {
+		return nil, ErrOutOfRange
+	}
+	chunk := obj.data[obj.offset : obj.offset+count]
+	obj.offset += count
+	return chunk, nil
+}
+
+// Byte reads a single byte
+func (obj *Parser) Byte() (byte, error) {
+	chunk, err := obj.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return chunk[0], nil
+}
+
+// UInt16 reads a uint16
+func (obj *Parser) UInt16() (uint16, error) {
+	chunk, err := obj.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(chunk), nil
+}
+
+// UInt32 reads a uint32
+func (obj *Parser) UInt32() (uint32, error) {
+	chunk, err := obj.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(chunk), nil
+}
+
+// UInt64 reads a uint64
+func (obj *Parser) UInt64() (uint64, error) {
+	chunk, err := obj.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(chunk), nil
+}
+
+// String reads a utf8 string of len bytes
+func (obj *Parser) String(len int) (string, error) {
+	chunk, err := obj.next(len)
+	if err != nil {
+		return "", err
+	}
+	return string(chunk), nil
+}
+
+// Chunk reads len raw bytes
+func (obj *Parser) Chunk(len int) ([]byte, error) {
+	return obj.next(len)
+}
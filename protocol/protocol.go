@@ -0,0 +1,127 @@
+// Package protocol implements the AppChatty wire format shared by the server,
+// the GTK client and any third-party tool that wants to talk to the server.
+//
+// Every frame begins with a uint16 data length followed by a uint16 operation
+// code, after which the data of the frame begins. All integers are little
+// endian. Responses use the same framing, with an HTTP-like status code in
+// place of the operation code. Packets with more than MaxDataLen bytes of data
+// are split into several frames, every frame but the last one has FlagMore
+// set in its operation code. A client may prefix the data of a request with
+// a request ID and set FlagRequest, the response then echoes the same ID so
+// several requests can be in flight at once (see Dispatcher).
+//
+// By default a client uses two connections: the command connection for its
+// requests and the subscription connection for the events (OpMessage,
+// OpCheckOnline) pushed by the server. With OptionMultiplex set in the
+// Credentials of OpAuth or OpRegister a single connection is used for both,
+// the events are then marked with FlagPush.
+package protocol
+
+// OpCode is the operation code (or response code) of a packet
+type OpCode uint16
+
+// Frame flags, operation codes never use these bits
+const (
+	// FlagMore marks a frame which is followed by more fragments of the same packet
+	FlagMore OpCode = 0x8000
+	// FlagRequest marks a packet whose data begins with a uint32 request ID.
+	// The response to such a packet carries the same request ID.
+	FlagRequest OpCode = 0x4000
+	// FlagPush marks an event pushed by the server on a multiplexed connection,
+	// where events share the socket with the responses
+	FlagPush OpCode = 0x2000
+
+	flagsMask = FlagMore | FlagRequest | FlagPush
+)
+
+// Operation codes
+const (
+	// OpMessage carries a chat message, see Message
+	OpMessage OpCode = 1
+	// OpCreateGroup creates a new group, see CreateGroupRequest
+	OpCreateGroup OpCode = 2
+	// OpGroupName resolves a group ID to its name, see GroupNameRequest
+	OpGroupName OpCode = 3
+	// OpRegister creates a new account, see Credentials
+	OpRegister OpCode = 4
+	// OpAuth authenticates the command connection, see Credentials
+	OpAuth OpCode = 5
+	// OpUserID resolves a username to its ID, see UserIDRequest
+	OpUserID OpCode = 6
+	// OpUsername resolves a user ID to its name, see UsernameRequest
+	OpUsername OpCode = 7
+	// OpCheckOnline asks for the online state of users, see CheckOnlineRequest.
+	// Changes of the state are pushed with the same opcode.
+	OpCheckOnline OpCode = 8
+	// OpSubscribe authenticates the subscription connection, see Credentials
+	OpSubscribe OpCode = 10
+	// OpAck acknowledges received messages, see AckRequest. No response
+	OpAck OpCode = 11
+	// OpReceipt is pushed to the sender of a message when its state changes, see Receipt
+	OpReceipt OpCode = 12
+	// OpHistory fetches a page of stored messages of a chat, see HistoryRequest
+	OpHistory OpCode = 13
+	// OpLogout revokes a session token and closes the session, see LogoutRequest
+	OpLogout OpCode = 14
+	// OpChangePassword replaces the password, see ChangePasswordRequest
+	OpChangePassword OpCode = 15
+	// OpDeleteAccount deletes the account of the user, see DeleteAccountRequest
+	OpDeleteAccount OpCode = 16
+	// OpPing is sent by both sides every PingInterval, answered with OpPong. No data
+	OpPing OpCode = 17
+	// OpPong answers OpPing. No data
+	OpPong OpCode = 18
+	// OpGroupCommand runs a slash command of a group without sending it as
+	// chat text, see GroupCommandRequest
+	OpGroupCommand OpCode = 19
+	// OpInvite is pushed to a user invited to a group, see Invite
+	OpInvite OpCode = 20
+	// OpAcceptInvite joins the group of an invitation, see InviteRequest and JoinResponse
+	OpAcceptInvite OpCode = 21
+	// OpDeclineInvite discards an invitation, see InviteRequest. No data in the response
+	OpDeclineInvite OpCode = 22
+	// OpSearchGroups finds public groups by name, see SearchGroupsRequest
+	OpSearchGroups OpCode = 23
+	// OpJoinGroup joins a public group, see JoinGroupRequest and JoinResponse
+	OpJoinGroup OpCode = 24
+	// OpGroupChanged is pushed with the name and topic of a group, see GroupChanged
+	OpGroupChanged OpCode = 25
+)
+
+// Delivery states of a message
+const (
+	// ReceiptSent the message was accepted by the server
+	ReceiptSent byte = 0
+	// ReceiptDelivered the message reached the client of the recipient
+	ReceiptDelivered byte = 1
+	// ReceiptRead the recipient opened the chat with the message
+	ReceiptRead byte = 2
+)
+
+// Response codes
+const (
+	// StatusOK OK
+	StatusOK OpCode = 200
+	// StatusAccepted Accepted. The message is queued for an offline recipient
+	StatusAccepted OpCode = 202
+	// StatusBadRequest Bad syntax
+	StatusBadRequest OpCode = 400
+	// StatusUnauthorized Unauthorized. No data
+	StatusUnauthorized OpCode = 401
+	// StatusForbidden Forbidden. The role of the user doesn't allow the operation, see ErrorResponse
+	StatusForbidden OpCode = 403
+	// StatusNotFound Not found. No data
+	StatusNotFound OpCode = 404
+	// StatusNotAcceptable Not Acceptable. No data
+	StatusNotAcceptable OpCode = 406
+	// StatusConflict Conflict. No data
+	StatusConflict OpCode = 409
+	// StatusPayloadTooLarge Payload too large. No data. The packet exceeds the server limit
+	StatusPayloadTooLarge OpCode = 413
+	// StatusLocked Locked. No data. Used in auth to notify that password is wrong
+	StatusLocked OpCode = 423
+	// StatusTooManyRequests Too many failed logins, see RetryResponse
+	StatusTooManyRequests OpCode = 429
+	// StatusServerError Internal server error. No data
+	StatusServerError OpCode = 500
+)
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Serializer builds the data of a packet field by field
+type Serializer struct {
+	buffer bytes.Buffer
+}
+
+// NewSerializer returns an empty Serializer
+func NewSerializer() *Serializer {
+	return &Serializer{}
+}
+
+// Bytes returns the serialized data
+func (obj *Serializer) Bytes() []byte {
+	return obj.buffer.Bytes()
+}
+
+// Byte writes a single byte
+func (obj *Serializer) Byte(input byte) error {
+	return obj.buffer.WriteByte(input)
+}
+
+// UInt16 writes a uint16
+func (obj *Serializer) UInt16(input uint16) error {
+	temp := make([]byte, 2)
+	binary.LittleEndian.PutUint16(temp, input)
+	_, err := obj.buffer.Write(temp)
+	return err
+}
+
+// UInt32 writes a uint32
+func (obj *Serializer) UInt32(input uint32) error {
+	temp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(temp, input)
+	_, err := obj.buffer.Write(temp)
+	return err
+}
+
+// UInt64 writes a uint64
+func (obj *Serializer) UInt64(input uint64) error {
+	temp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(temp, input)
+	_, err := obj.buffer.Write(temp)
+	return err
+}
+
+// String writes a utf8 string prefixed with its length, lenLen is the size
+// of the length field in bytes (1, 2 or 4)
+func (obj *Serializer) String(input string, lenLen int) error {
+	return obj.Chunk([]byte(input), lenLen)
+}
+
+// Chunk writes raw bytes prefixed with their length, lenLen is the size of
+// the length field in bytes (1, 2 or 4)
+func (obj *Serializer) Chunk(input []byte, lenLen int) error {
+	len := len(input)
+	var err error
+	switch lenLen {
+	case 1:
+		if len > 255 {
+			return errors.New("String is too long")
+		}
+		err = obj.Byte(byte(len))
+	case 2:
+		if len > 65535 {
+			return errors.New("String is too long")
+		}
+		err = obj.UInt16(uint16(len))
+	default:
+		if uint64(len) > 0xFFFFFFFF {
+			return errors.New("String is too long")
+		}
+		err = obj.UInt32(uint32(len))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = obj.buffer.Write(input)
+	return err
+}